@@ -0,0 +1,536 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cyverse-de/vaulter"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The results of bringing a resource in line with its description.
+const (
+	resultCreated   = "created"
+	resultUpdated   = "updated"
+	resultUnchanged = "unchanged"
+	resultPending   = "pending"
+)
+
+// applySpec is the description of a Vault setup read by 'apply'. Each resource
+// is described with the flags of the 'init' command for it, without the
+// leading dashes.
+type applySpec struct {
+	RootCA          map[string]interface{}   `yaml:"root-ca"`
+	IntermediateCAs []map[string]interface{} `yaml:"intermediate-cas"`
+	Roles           []map[string]interface{} `yaml:"roles"`
+}
+
+// applyNode is a resource in the dependency graph built from an applySpec.
+type applyNode struct {
+	name   string
+	deps   []*applyNode
+	apply  func(w *tabwriter.Writer) string
+	result string
+}
+
+// Apply contains the command for converging Vault on a description of the
+// Discovery Environment's PKI setup.
+type Apply struct {
+	path  string
+	Apply *cobra.Command
+	Plan  *cobra.Command
+}
+
+// NewApply returns a newly instantiated *Apply.
+func NewApply() *Apply {
+	a := &Apply{
+		Apply: &cobra.Command{
+			Use:         "apply",
+			Short:       "Converges Vault on the setup described in a file.",
+			Annotations: map[string]string{dryRunAnnotation: "true", destructiveAnnotation: "true"},
+			Long: `Reads the root CA, intermediate CAs, and roles described in the YAML
+file at --file and brings Vault in line with them. The root CA is applied
+first, followed by the intermediate CAs that it signs, the roles in each
+backend, and finally the CA and CRL URLs of the intermediate CAs. Only what
+differs is changed, and a summary of which resources were created, updated,
+or left unchanged is printed at the end.
+
+Each resource takes the same settings as the flags of its 'init' command:
+
+  root-ca:
+    mount: root-ca
+    common-name: DE Root CA
+    key-type: ec
+    ttl: 87600h
+  intermediate-cas:
+    - mount: intermediate-ca
+      root-mount: root-ca
+      common-name: DE Intermediate CA
+      base-url: https://vault.example.org:8200
+  roles:
+    - mount: intermediate-ca
+      role: de
+      allowed-domain: [example.org]
+      allow-subdomains: true
+
+Existing root and intermediate CA certs are never replaced. Differences from
+the requested settings are reported as warnings; use 'remove root-ca' or
+'rotate intermediate-ca' to replace them. An intermediate CA backend that is
+mounted without a cert, e.g. while its CSR is out for signing, is reported as
+pending; use 'import intermediate-ca' to finish it. Use 'plan' to see the
+changes that would be made beforehand.`,
+		},
+		Plan: &cobra.Command{
+			Use:         "plan",
+			Short:       "Shows the changes that 'apply' would make.",
+			Annotations: map[string]string{dryRunAnnotation: "true"},
+			Long: `Works out what 'apply' would do with the file at --file without making
+any changes to Vault. The results that 'apply' would report for each resource
+are printed, followed by each mount, unmount, write, and delete that it would
+perform, with the data currently in Vault shown alongside the data that would
+replace it. Exits with 0 if no changes are pending and 2 if there are.`,
+		},
+	}
+
+	a.Apply.Run = a.applyRun
+	a.Plan.Run = a.planRun
+
+	for _, c := range []*cobra.Command{a.Apply, a.Plan} {
+		c.PersistentFlags().StringVarP(
+			&a.path,
+			"file",
+			"f",
+			"",
+			"The path to the YAML file describing the setup.",
+		)
+	}
+
+	return a
+}
+
+// setFlags sets the command's flags from the settings for a resource.
+func setFlags(c *cobra.Command, settings map[string]interface{}) error {
+	for name, value := range settings {
+		if c.PersistentFlags().Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if err := c.PersistentFlags().Set(name, flagString(value)); err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// tuneMount sets the max lease TTL of the backend at the given path if it
+// differs from maxTTL. Returns true if it was changed.
+func tuneMount(w *tabwriter.Writer, mount, maxTTL string) bool {
+	fmt.Fprint(w, "Setting the max lease TTL of the backend:\t")
+	desired, err := parseTTL(maxTTL)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	tunePath := fmt.Sprintf("sys/mounts/%s/tune", mount)
+	tuneSecret, err := vaultAPI.Read(vaultAPI.Client(), tunePath)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if tuneSecret == nil || tuneSecret.Data == nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, fmt.Errorf("no settings found for %s", mount))
+	}
+	actual, err := dataDuration(tuneSecret.Data["max_lease_ttl"])
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if actual == desired {
+		fmt.Fprint(w, "SUCCESS\t\n")
+		return false
+	}
+	if _, err = vaultAPI.Write(vaultAPI.Client(), tunePath, map[string]interface{}{"max_lease_ttl": maxTTL}); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprintf(w, "SUCCESS (changed from %s to %s)\t\n", actual, desired)
+	return true
+}
+
+// rootCANode returns the node for the root CA described by the settings.
+func rootCANode(settings map[string]interface{}) (*applyNode, string, error) {
+	r := NewRootCA()
+	if err := setFlags(r.Init, settings); err != nil {
+		return nil, "", fmt.Errorf("root-ca: %s", err)
+	}
+	if r.mount == "" || r.role == "" || r.commonName == "" {
+		return nil, "", errors.New("root-ca: mount, role, and common-name must be set")
+	}
+	if err := r.keys.validate(); err != nil {
+		return nil, "", fmt.Errorf("root-ca: %s", err)
+	}
+	ttls, err := parseTTLs(map[string]string{
+		"mount-max-ttl": r.mountMaxTTL,
+		"ttl":           r.ttl,
+	})
+	if err == nil {
+		err = checkTTL("ttl", ttls["ttl"], "mount-max-ttl", ttls["mount-max-ttl"])
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("root-ca: %s", err)
+	}
+
+	n := &applyNode{name: fmt.Sprintf("root-ca %s", r.mount)}
+	n.apply = func(w *tabwriter.Writer) string {
+		result := r.init(w, ttls["ttl"])
+		// A newly mounted backend already has the requested max lease TTL.
+		if result != resultCreated && tuneMount(w, r.mount, r.mountMaxTTL) {
+			result = resultUpdated
+		}
+		return result
+	}
+	return n, r.mount, nil
+}
+
+// intermediateCANodes returns the nodes for the intermediate CA described by
+// the settings and for its CA and CRL URLs.
+func intermediateCANodes(settings map[string]interface{}) (*IntermediateCA, *applyNode, *applyNode, error) {
+	i := NewIntermediateCA()
+	if err := setFlags(i.Init, settings); err != nil {
+		return nil, nil, nil, fmt.Errorf("intermediate-ca: %s", err)
+	}
+	if i.mount == "" || i.rootMount == "" || i.commonName == "" {
+		return nil, nil, nil, errors.New("intermediate-ca: mount, root-mount, and common-name must be set")
+	}
+	if i.csrOut != "" {
+		return nil, nil, nil, fmt.Errorf("intermediate-ca %s: csr-out is not supported, use 'init intermediate-ca'", i.mount)
+	}
+	if err := i.keys.validate(); err != nil {
+		return nil, nil, nil, fmt.Errorf("intermediate-ca %s: %s", i.mount, err)
+	}
+	ttls, err := parseTTLs(map[string]string{
+		"mount-max-ttl": i.mountMaxTTL,
+		"ttl":           i.ttl,
+	})
+	if err == nil {
+		err = checkTTL("ttl", ttls["ttl"], "mount-max-ttl", ttls["mount-max-ttl"])
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("intermediate-ca %s: %s", i.mount, err)
+	}
+
+	ca := &applyNode{name: fmt.Sprintf("intermediate-ca %s", i.mount)}
+	ca.apply = func(w *tabwriter.Writer) string {
+		fmt.Fprint(w, "Intermediate CA backend is mounted:\t")
+		mounted, err := vaulter.IsMounted(vaultAPI, i.mount)
+		if err != nil {
+			fmt.Fprint(w, "UNKNOWN\t\n")
+			FatalFlush(w, err)
+		}
+		if mounted {
+			fmt.Fprint(w, "YES\t\n")
+		} else {
+			fmt.Fprint(w, "NO\t\n")
+		}
+
+		fmt.Fprint(w, "Intermediate CA cert already imported:\t")
+		var caCert *x509.Certificate
+		if mounted {
+			if caCert, err = readCACert(vaultAPI, i.mount); err != nil {
+				fmt.Fprint(w, "UNKNOWN\t\n")
+				FatalFlush(w, err)
+			}
+		}
+		if caCert == nil && mounted {
+			// The backend is left mounted without a cert when the CSR from
+			// 'init intermediate-ca --csr-out' hasn't been signed yet, or when
+			// an earlier run failed midway. Generating a new CSR would
+			// invalidate the one that may be out for signing.
+			importArgs := []string{"--mount", i.mount, "--cert", "<signed cert>"}
+			importArgs = append(importArgs, changedFlags(i.Init, "base-url")...)
+			fmt.Fprintf(
+				w,
+				"NO (CSR pending or 'init intermediate-ca' failed midway, use '%s')\t\n",
+				commandLine("import intermediate-ca", importArgs...),
+			)
+			return resultPending
+		}
+		if caCert == nil {
+			fmt.Fprint(w, "NO\t\n")
+			i.checkRootLifetime(w)
+			i.mountBackend(w, i.mount)
+			csr := i.generateCSR(w, i.mount)
+			cert := i.signCSR(w, csr)
+			i.importCert(w, i.mount, cert)
+			return resultCreated
+		}
+		fmt.Fprint(w, "YES\t\n")
+
+		fmt.Fprint(w, "Intermediate CA cert matches the requested settings:\t")
+		var diffs []string
+		if caCert.Subject.CommonName != i.commonName {
+			diffs = append(diffs, fmt.Sprintf("common name is %s, not %s", caCert.Subject.CommonName, i.commonName))
+		}
+		if actual := certKeySettings(caCert); actual.String() != i.keys.String() {
+			diffs = append(diffs, fmt.Sprintf("key is %s, not %s", actual, &i.keys))
+		}
+		if len(diffs) > 0 {
+			fmt.Fprintf(w, "NO (WARNING: %s, use 'rotate intermediate-ca' to replace it)\t\n", strings.Join(diffs, "; "))
+		} else {
+			fmt.Fprint(w, "YES\t\n")
+		}
+
+		if tuneMount(w, i.mount, i.mountMaxTTL) {
+			return resultUpdated
+		}
+		return resultUnchanged
+	}
+
+	urls := &applyNode{name: fmt.Sprintf("urls %s", i.mount), deps: []*applyNode{ca}}
+	urls.apply = func(w *tabwriter.Writer) string {
+		fmt.Fprint(w, "CA and CRL URLs are configured:\t")
+		configured, err := i.urlsConfigured(i.mount)
+		if err != nil {
+			fmt.Fprint(w, "UNKNOWN\t\n")
+			FatalFlush(w, err)
+		}
+		if configured {
+			fmt.Fprint(w, "YES\t\n")
+			return resultUnchanged
+		}
+		fmt.Fprint(w, "NO\t\n")
+		i.configureURLs(w, i.mount)
+		if ca.result == resultCreated {
+			return resultCreated
+		}
+		return resultUpdated
+	}
+	return i, ca, urls, nil
+}
+
+// roleNode returns the node for the role described by the settings.
+func roleNode(settings map[string]interface{}) (*Role, *applyNode, error) {
+	r := NewRole()
+	if err := setFlags(r.Init, settings); err != nil {
+		return nil, nil, fmt.Errorf("role: %s", err)
+	}
+	if r.mount == "" || r.role == "" {
+		return nil, nil, errors.New("role: mount and role must be set")
+	}
+	if err := r.validate(); err != nil {
+		return nil, nil, fmt.Errorf("role %s/%s: %s", r.mount, r.role, err)
+	}
+
+	n := &applyNode{name: fmt.Sprintf("role %s/%s", r.mount, r.role)}
+	n.apply = func(w *tabwriter.Writer) string {
+		fmt.Fprint(w, "Role matches the desired settings:\t")
+		roleSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", r.mount, r.role))
+		if err != nil {
+			fmt.Fprint(w, "UNKNOWN\t\n")
+			FatalFlush(w, err)
+		}
+		result := resultCreated
+		if roleSecret != nil && roleSecret.Data != nil {
+			diffs := r.differences(roleSecret.Data)
+			if len(diffs) == 0 {
+				fmt.Fprint(w, "YES\t\n")
+				return resultUnchanged
+			}
+			fmt.Fprintf(w, "NO (%s differ)\t\n", strings.Join(diffs, ", "))
+			result = resultUpdated
+		} else {
+			fmt.Fprint(w, "NO (role does not exist)\t\n")
+		}
+
+		fmt.Fprint(w, "Writing the role:\t")
+		if err = r.write(); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+		return result
+	}
+	return r, n, nil
+}
+
+// buildApplyGraph returns the nodes for the resources in the spec, ordered so
+// that each node comes after the nodes it depends on. Intermediate CAs depend
+// on the CA that signs them, roles depend on the CA in their backend, and the
+// URLs of an intermediate CA depend on the intermediate CA.
+func buildApplyGraph(spec *applySpec) ([]*applyNode, error) {
+	var (
+		nodes []*applyNode
+		urls  []*applyNode
+	)
+	cas := map[string]*applyNode{}
+	addCA := func(mount string, n *applyNode) error {
+		if _, ok := cas[mount]; ok {
+			return fmt.Errorf("more than one CA uses the backend at %s", mount)
+		}
+		cas[mount] = n
+		nodes = append(nodes, n)
+		return nil
+	}
+
+	if spec.RootCA != nil {
+		n, mount, err := rootCANode(spec.RootCA)
+		if err != nil {
+			return nil, err
+		}
+		if err = addCA(mount, n); err != nil {
+			return nil, err
+		}
+	}
+
+	signers := map[*applyNode]string{}
+	for _, settings := range spec.IntermediateCAs {
+		i, ca, u, err := intermediateCANodes(settings)
+		if err != nil {
+			return nil, err
+		}
+		if err = addCA(i.mount, ca); err != nil {
+			return nil, err
+		}
+		signers[ca] = i.rootMount
+		urls = append(urls, u)
+	}
+	for ca, rootMount := range signers {
+		if signer, ok := cas[rootMount]; ok {
+			ca.deps = append(ca.deps, signer)
+		}
+	}
+
+	roles := map[string]bool{}
+	for _, settings := range spec.Roles {
+		r, n, err := roleNode(settings)
+		if err != nil {
+			return nil, err
+		}
+		if roles[n.name] {
+			return nil, fmt.Errorf("%s is described more than once", n.name)
+		}
+		roles[n.name] = true
+		if ca, ok := cas[r.mount]; ok {
+			n.deps = append(n.deps, ca)
+		}
+		nodes = append(nodes, n)
+	}
+	nodes = append(nodes, urls...)
+
+	// Order the nodes with a depth-first search, which keeps the order above
+	// wherever the dependencies allow it.
+	const (
+		visiting = iota + 1
+		visited
+	)
+	var sorted []*applyNode
+	state := map[*applyNode]int{}
+	var visit func(n *applyNode) error
+	visit = func(n *applyNode) error {
+		switch state[n] {
+		case visiting:
+			return fmt.Errorf("dependency cycle involving %s", n.name)
+		case visited:
+			return nil
+		}
+		state[n] = visiting
+		for _, d := range n.deps {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[n] = visited
+		sorted = append(sorted, n)
+		return nil
+	}
+	for _, n := range nodes {
+		if err := visit(n); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// readNodes reads the file at --file and returns the nodes for the resources
+// in it, in the order that they're applied.
+func (a *Apply) readNodes() []*applyNode {
+	if a.path == "" {
+		log.Fatal("--file must be set.")
+	}
+	contents, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec := &applySpec{}
+	if err = yaml.Unmarshal(contents, spec); err != nil {
+		log.Fatal(err)
+	}
+	nodes, err := buildApplyGraph(spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(nodes) == 0 {
+		log.Fatalf("no resources are described in %s", a.path)
+	}
+	return nodes
+}
+
+// applyNodes applies each of the nodes in order, writing the steps taken to w,
+// and then writes a summary of the results.
+func applyNodes(w *tabwriter.Writer, summary *tabwriter.Writer, nodes []*applyNode) {
+	counts := map[string]int{}
+	for idx, n := range nodes {
+		if idx > 0 {
+			fmt.Fprint(w, "\n")
+		}
+		fmt.Fprintf(w, "Applying %s:\t\t\n", n.name)
+		n.result = n.apply(w)
+		counts[n.result]++
+	}
+	w.Flush()
+
+	fmt.Fprint(summary, "\nRESOURCE\tRESULT\t\n")
+	for _, n := range nodes {
+		fmt.Fprintf(summary, "%s\t%s\t\n", n.name, n.result)
+	}
+	fmt.Fprintf(
+		summary,
+		"\n%d created, %d updated, %d unchanged, %d pending\t\n",
+		counts[resultCreated],
+		counts[resultUpdated],
+		counts[resultUnchanged],
+		counts[resultPending],
+	)
+	summary.Flush()
+}
+
+func (a *Apply) applyRun(cmd *cobra.Command, args []string) {
+	nodes := a.readNodes()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	applyNodes(w, w, nodes)
+}
+
+// planRun applies the nodes with the changes recorded instead of made. Only
+// the summary is printed, followed by the plan itself once the command
+// finishes.
+func (a *Apply) planRun(cmd *cobra.Command, args []string) {
+	nodes := a.readNodes()
+	if _, ok := vaultAPI.(*recorder); !ok {
+		vaultAPI = newRecorder(vaultAPI)
+	}
+	steps := tabwriter.NewWriter(ioutil.Discard, 0, 0, 1, ' ', tabwriter.StripEscape)
+	summary := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	applyNodes(steps, summary, nodes)
+}
+
+func init() {
+	a := NewApply()
+	RootCmd.AddCommand(a.Apply, a.Plan)
+}
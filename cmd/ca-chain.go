@@ -0,0 +1,482 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cyverse-de/vaulter"
+	"github.com/spf13/cobra"
+)
+
+// CAChain contains the commands for exporting the chain of CA certs used by the
+// Discovery Environment.
+type CAChain struct {
+	rootMount string
+	mounts    []string
+	out       string
+	hashedDir string
+	Export    *cobra.Command
+}
+
+// NewCAChain returns a newly instantiated *CAChain.
+func NewCAChain() *CAChain {
+	c := &CAChain{
+		Export: &cobra.Command{
+			Use:   "ca-chain",
+			Short: "Exports the CA cert chain as a trust bundle.",
+			Long: `Exports the CA certs of the PKI backends at --mount, along with the
+chains imported into them and the CA cert of the root CA at --root-mount. The
+certs are ordered from the intermediate CAs up to the root and duplicates are
+removed. Use --out to write a PEM bundle, and --hashed-dir to write a directory
+containing a .crt file per cert, named after its SHA-256 fingerprint, and the
+hashed symlinks that OpenSSL uses to look up CA certs, the same layout that
+c_rehash produces. Hashed symlinks left in the directory by earlier exports are
+removed, along with the .crt files that they wrote for certs that are no longer
+in the chain. The .crt files written are listed in .de-vault-certs in the
+directory.`,
+		},
+	}
+
+	c.Export.Run = c.exportRun
+
+	c.Export.PersistentFlags().StringVar(
+		&c.rootMount,
+		"root-mount",
+		defaultRootMount,
+		"The path in Vault to the root CA pki backend. Set to an empty string if the root CA is not in Vault.",
+	)
+	c.Export.PersistentFlags().StringSliceVar(
+		&c.mounts,
+		"mount",
+		[]string{defaultIntMount},
+		"The path in Vault to an intermediate CA pki backend. May be repeated.",
+	)
+	c.Export.PersistentFlags().StringVar(
+		&c.out,
+		"out",
+		"",
+		"The file path for the PEM bundle.",
+	)
+	c.Export.PersistentFlags().StringVar(
+		&c.hashedDir,
+		"hashed-dir",
+		"",
+		"The path to a directory to write the certs and their OpenSSL hashed symlinks to.",
+	)
+
+	return c
+}
+
+// readImportedChain reads the CA chain stored in the mount. Intermediates
+// signed by an offline root have their chain imported along with them. Older
+// versions of Vault don't support reading it, so failures to read it result in
+// an empty chain rather than an error.
+func readImportedChain(mount string) ([]*x509.Certificate, error) {
+	chainSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/cert/ca_chain", mount))
+	if err != nil || chainSecret == nil || chainSecret.Data == nil {
+		return nil, nil
+	}
+	contents, ok := chainSecret.Data["certificate"].(string)
+	if !ok || strings.TrimSpace(contents) == "" {
+		return nil, nil
+	}
+	return parseCertsPEM(contents)
+}
+
+// readCAChain reads the CA certs for the mounts and the root mount, ordered
+// from the intermediates up to the root, with duplicates removed.
+func readCAChain(mounts []string, rootMount string) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	add := func(c *x509.Certificate) {
+		for _, existing := range chain {
+			if bytes.Equal(existing.Raw, c.Raw) {
+				return
+			}
+		}
+		chain = append(chain, c)
+	}
+	for _, m := range mounts {
+		caCert, err := readCACert(vaultAPI, m)
+		if err != nil {
+			return nil, err
+		}
+		if caCert == nil {
+			return nil, fmt.Errorf("no CA cert found in %s", m)
+		}
+		add(caCert)
+
+		certs, err := readImportedChain(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range certs {
+			add(c)
+		}
+	}
+	if rootMount != "" {
+		rootCert, err := readCACert(vaultAPI, rootMount)
+		if err != nil {
+			return nil, err
+		}
+		if rootCert == nil {
+			return nil, fmt.Errorf("no CA cert found in %s", rootMount)
+		}
+		add(rootCert)
+	}
+	return chain, nil
+}
+
+// readTrustChain reads the CA certs that clients of the certs issued by mount
+// should trust: the chain returned by readCAChain, with the certs of the
+// intermediate CAs that 'rotate intermediate-ca' switched away from in favor
+// of mount added after the one in mount, the same order as the bundle written
+// by its --chain-out. The old intermediates are left out once they've been
+// removed or have expired, so the overlap only lasts while certs issued by
+// them can still be in use.
+func readTrustChain(mount, rootMount string) ([]*x509.Certificate, error) {
+	chain, err := readCAChain([]string{mount}, rootMount)
+	if err != nil {
+		return nil, err
+	}
+	retiring, err := retiringMounts(mount)
+	if err != nil {
+		return nil, err
+	}
+	var old []*x509.Certificate
+	for _, m := range retiring {
+		mounted, err := vaulter.IsMounted(vaultAPI, m)
+		if err != nil {
+			return nil, err
+		}
+		if !mounted {
+			continue
+		}
+		caCert, err := readCACert(vaultAPI, m)
+		if err != nil {
+			return nil, err
+		}
+		if caCert == nil || time.Now().After(caCert.NotAfter) {
+			continue
+		}
+		duplicate := false
+		for _, c := range append(chain, old...) {
+			duplicate = duplicate || bytes.Equal(c.Raw, caCert.Raw)
+		}
+		if !duplicate {
+			old = append(old, caCert)
+		}
+	}
+	if len(old) == 0 {
+		return chain, nil
+	}
+	return append(append(chain[:1:1], old...), chain[1:]...), nil
+}
+
+// isNameSpace reports whether b is one of the ASCII whitespace characters that
+// OpenSSL collapses in name values. Other whitespace is left alone.
+func isNameSpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+// canonicalNameValue applies the canonicalization that OpenSSL uses for name
+// hashes to a UTF-8 value: leading and trailing whitespace is removed, runs of
+// whitespace are collapsed into a single space, and ASCII letters are
+// lowercased.
+func canonicalNameValue(v string) string {
+	var out []byte
+	for i := 0; i < len(v); i++ {
+		b := v[i]
+		switch {
+		case isNameSpace(b):
+			for i+1 < len(v) && isNameSpace(v[i+1]) {
+				i++
+			}
+			out = append(out, ' ')
+		case b >= 'A' && b <= 'Z':
+			out = append(out, b+'a'-'A')
+		default:
+			out = append(out, b)
+		}
+	}
+	return strings.TrimFunc(string(out), func(r rune) bool { return r == ' ' })
+}
+
+type nameAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// nameAttributeSET is named so that encoding/asn1 treats it as a SET OF.
+type nameAttributeSET []nameAttribute
+
+// The ASN.1 string types that aren't defined by encoding/asn1.
+const (
+	tagVisibleString   = 26
+	tagUniversalString = 28
+	tagBMPString       = 30
+)
+
+// nameValueUTF8 converts a name value to UTF-8 the way OpenSSL's
+// ASN1_STRING_to_UTF8 does before canonicalizing it. The single byte string
+// types are read as Latin-1, BMPString as UCS-2, and UniversalString as UCS-4.
+// Returns false for the types that OpenSSL hashes as they are.
+func nameValueUTF8(v asn1.RawValue) (string, bool, error) {
+	if v.Class != asn1.ClassUniversal {
+		return "", false, nil
+	}
+	var width int
+	switch v.Tag {
+	case asn1.TagUTF8String:
+		if !utf8.Valid(v.Bytes) {
+			return "", false, errors.New("invalid UTF8String in name")
+		}
+		return string(v.Bytes), true, nil
+	case asn1.TagPrintableString, asn1.TagT61String, asn1.TagIA5String, tagVisibleString:
+		width = 1
+	case tagBMPString:
+		width = 2
+	case tagUniversalString:
+		width = 4
+	default:
+		return "", false, nil
+	}
+	if len(v.Bytes)%width != 0 {
+		return "", false, fmt.Errorf("invalid string of type %d in name", v.Tag)
+	}
+	var runes []rune
+	for i := 0; i < len(v.Bytes); i += width {
+		var r rune
+		for _, b := range v.Bytes[i : i+width] {
+			r = r<<8 | rune(b)
+		}
+		if !utf8.ValidRune(r) {
+			return "", false, fmt.Errorf("invalid character in string of type %d in name", v.Tag)
+		}
+		runes = append(runes, r)
+	}
+	return string(runes), true, nil
+}
+
+// subjectHash computes the hash of the cert's subject that OpenSSL uses to
+// name the symlinks in a CA directory, the same value printed by
+// 'openssl x509 -subject_hash'.
+func subjectHash(c *x509.Certificate) (uint32, error) {
+	var rdns []nameAttributeSET
+	if _, err := asn1.Unmarshal(c.RawSubject, &rdns); err != nil {
+		return 0, err
+	}
+	var canon []byte
+	for _, rdn := range rdns {
+		var attrs [][]byte
+		for _, attr := range rdn {
+			value, ok, err := nameValueUTF8(attr.Value)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				canonValue, err := asn1.MarshalWithParams(canonicalNameValue(value), "utf8")
+				if err != nil {
+					return 0, err
+				}
+				attr.Value = asn1.RawValue{FullBytes: canonValue}
+			}
+			encoded, err := asn1.Marshal(attr)
+			if err != nil {
+				return 0, err
+			}
+			attrs = append(attrs, encoded)
+		}
+		// DER sorts the members of a SET OF by their encodings, which matters
+		// for multi-valued RDNs.
+		sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+		encoded, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(attrs, nil)})
+		if err != nil {
+			return 0, err
+		}
+		canon = append(canon, encoded...)
+	}
+	sum := sha1.Sum(canon)
+	return uint32(sum[0]) | uint32(sum[1])<<8 | uint32(sum[2])<<16 | uint32(sum[3])<<24, nil
+}
+
+// hashLinkName matches the names of the symlinks in a hashed CA directory.
+var hashLinkName = regexp.MustCompile(`^[0-9a-f]{8}\.[0-9]+$`)
+
+// hashedDirManifest is the file in a hashed CA directory that lists the .crt
+// files written by the last export, so that the ones that are no longer
+// exported can be removed without touching files that de-vault didn't write.
+const hashedDirManifest = ".de-vault-certs"
+
+// removeHashLinks removes the hashed symlinks from dir, the same as c_rehash
+// does before creating them again, so that links to certs that are no longer
+// exported don't linger.
+func removeHashLinks(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Mode()&os.ModeSymlink == 0 || !hashLinkName.MatchString(e.Name()) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHashedDirManifest returns the names of the .crt files listed in the
+// manifest in dir. A missing manifest is treated as an empty one.
+func readHashedDirManifest(dir string) ([]string, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, hashedDirManifest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(contents), "\n") {
+		// Only plain file names are accepted so that an edited manifest can't
+		// be used to remove files outside of dir.
+		if name != "" && name == filepath.Base(name) && strings.HasSuffix(name, ".crt") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// writeHashedDir writes each cert to dir as a .crt file named after its
+// SHA-256 fingerprint, along with a <hash>.<n> symlink pointing at it. Naming
+// the files after the fingerprints keeps certs with the same common name, such
+// as an intermediate CA and the one that replaced it, from overwriting each
+// other. The .crt files written by an earlier export that are no longer in
+// the chain are removed.
+func writeHashedDir(dir string, chain []*x509.Certificate) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	previous, err := readHashedDirManifest(dir)
+	if err != nil {
+		return err
+	}
+	if err = removeHashLinks(dir); err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	written := map[string]bool{}
+	var names []string
+	for _, c := range chain {
+		name := fmt.Sprintf("%x.crt", sha256.Sum256(c.Raw))
+		if err = writeFilesAtomic(&outputFile{path: filepath.Join(dir, name), contents: encodeCertPEM(c), perm: 0644}); err != nil {
+			return err
+		}
+		written[name] = true
+		names = append(names, name)
+
+		hash, err := subjectHash(c)
+		if err != nil {
+			return err
+		}
+		for n := 0; ; n++ {
+			link := fmt.Sprintf("%08x.%d", hash, n)
+			if used[link] {
+				continue
+			}
+			used[link] = true
+			if err = os.Symlink(name, filepath.Join(dir, link)); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	manifest := &outputFile{
+		path:     filepath.Join(dir, hashedDirManifest),
+		contents: []byte(strings.Join(names, "\n") + "\n"),
+		perm:     0644,
+	}
+	if err = writeFilesAtomic(manifest); err != nil {
+		return err
+	}
+	for _, name := range previous {
+		if written[name] {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CAChain) exportRun(cmd *cobra.Command, args []string) {
+	if len(c.mounts) == 0 {
+		log.Fatal("--mount must be set.")
+	}
+	if c.out == "" && c.hashedDir == "" {
+		log.Fatal("--out or --hashed-dir must be set.")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Reading the CA certs:\t")
+	chain, err := readCAChain(c.mounts, c.rootMount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	for _, caCert := range chain {
+		fmt.Fprintf(w, "CA cert:\t%s (expires %s)\t\n", formatName(caCert.Subject), caCert.NotAfter.Format("2006-01-02"))
+	}
+
+	if c.out != "" {
+		fmt.Fprint(w, "Writing the PEM bundle:\t")
+		var bundle []byte
+		for _, caCert := range chain {
+			bundle = append(bundle, encodeCertPEM(caCert)...)
+		}
+		if err = writeFilesAtomic(&outputFile{path: c.out, contents: bundle, perm: 0644}); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+
+	if c.hashedDir != "" {
+		fmt.Fprint(w, "Writing the hashed CA directory:\t")
+		if err = writeHashedDir(c.hashedDir, chain); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+	w.Flush()
+}
+
+func init() {
+	c := NewCAChain()
+	exportCmd.AddCommand(c.Export)
+}
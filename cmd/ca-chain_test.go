@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSubjectHash(t *testing.T) {
+	// The expected hashes were printed by 'openssl x509 -subject_hash' for
+	// certs with these DER encoded subjects.
+	tests := []struct {
+		name    string
+		subject string
+		hash    uint32
+	}{
+		{
+			"PrintableString",
+			"3015311330110603550403130a4578616d706c65204341",
+			0x119708d0,
+		},
+		{
+			"UTF8String with whitespace and capitals",
+			"301d311b301906035504030c1220204578616d706c6520090a202043412020",
+			0x119708d0,
+		},
+		{
+			"UTF8String with non-ASCII capitals",
+			"30173115301306035504030c0cc39c6ec3af636f6465204341",
+			0x5f87640c,
+		},
+		{
+			"UTF8String with a leading no-break space",
+			"30173115301306035504030c0cc2a04578616d706c65204341",
+			0x724a3f4e,
+		},
+		{
+			"BMPString",
+			"30273125302306035504031e1c004500780061006d0070006c006500200042004d0050002000430041",
+			0x42e8cc3e,
+		},
+		{
+			"BMPString with non-ASCII and whitespace",
+			"30293127302506035504031e1e0020002000dc006e00ef0063006f00640065002000200042004d00500020",
+			0xf30e7dcd,
+		},
+		{
+			"UniversalString",
+			"305b3159305706035504031c500000004500000078000000610000006d000000700000006c0000006500000020000000550000006e0000006900000076000000650000007200000073000000610000006c000000200000004300000041",
+			0xc048af2c,
+		},
+		{
+			"UniversalString outside the BMP",
+			"301b3119301706035504031c100000004300000041000000200001f512",
+			0xf14500dd,
+		},
+		{
+			"T61String with Latin-1",
+			"30123110300e06035504031407436166e9204341",
+			0xaefaca7d,
+		},
+		{
+			"IA5String",
+			"301f311d301b06092a864886f70d010901160e4341404578616d706c652e4f5247",
+			0xf9878508,
+		},
+		{
+			"several RDNs",
+			"3038310b300906035504061302555331143012060355040a0c0b4578616d706c65204f72673113301106035504030c0a4578616d706c65204341",
+			0x190cc36e,
+		},
+		{
+			"multi-valued RDN in DER order",
+			"30293127301106035504030c0a4578616d706c652043413012060355040a0c0b4578616d706c65204f7267",
+			0xe6381906,
+		},
+		{
+			"multi-valued RDN out of DER order",
+			"302931273012060355040a0c0b4578616d706c65204f7267301106035504030c0a4578616d706c65204341",
+			0xe6381906,
+		},
+	}
+
+	for _, test := range tests {
+		subject, err := hex.DecodeString(test.subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := subjectHash(&x509.Certificate{RawSubject: subject})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if hash != test.hash {
+			t.Errorf("%s: expected %08x, got %08x", test.name, test.hash, hash)
+		}
+	}
+}
+
+func TestWriteHashedDirRemovesStaleCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashed-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, oldCert := testCert(t, "Example CA")
+	_, newCert := testCert(t, "Example CA")
+	certFile := func(c *x509.Certificate) string {
+		return filepath.Join(dir, fmt.Sprintf("%x.crt", sha256.Sum256(c.Raw)))
+	}
+	other := filepath.Join(dir, "other.crt")
+	if err = ioutil.WriteFile(other, encodeCertPEM(oldCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = writeHashedDir(dir, []*x509.Certificate{newCert, oldCert}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(certFile(oldCert)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = writeHashedDir(dir, []*x509.Certificate{newCert}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(certFile(oldCert)); !os.IsNotExist(err) {
+		t.Error("expected the cert that is no longer exported to be removed")
+	}
+	if _, err = os.Stat(certFile(newCert)); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Error("expected the file that wasn't written by an export to be kept")
+	}
+
+	hash, err := subjectHash(newCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.Readlink(filepath.Join(dir, fmt.Sprintf("%08x.0", hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != filepath.Base(certFile(newCert)) {
+		t.Errorf("expected the hashed symlink to point at %s, got %s", filepath.Base(certFile(newCert)), target)
+	}
+	if _, err = os.Lstat(filepath.Join(dir, fmt.Sprintf("%08x.1", hash))); !os.IsNotExist(err) {
+		t.Error("expected the hashed symlink for the removed cert to be removed")
+	}
+}
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultWorkers = 10
+
+// defaultMaxCerts is the size of an intermediate CA's cert store above which
+// 'check intermediate-ca' suggests running 'tidy'.
+const defaultMaxCerts = 10000
+
+// certRecord is a cert stored in a PKI backend along with its revocation
+// status.
+type certRecord struct {
+	serial    string
+	cert      *x509.Certificate
+	revokedAt time.Time // The zero value if the cert has not been revoked.
+}
+
+// revoked returns true if the cert has been revoked.
+func (c *certRecord) revoked() bool {
+	return !c.revokedAt.IsZero()
+}
+
+// byNotAfter sorts cert records by expiration, soonest first.
+type byNotAfter []*certRecord
+
+func (b byNotAfter) Len() int           { return len(b) }
+func (b byNotAfter) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byNotAfter) Less(i, j int) bool { return b[i].cert.NotAfter.Before(b[j].cert.NotAfter) }
+
+// dataTime converts a Unix timestamp returned by Vault into a time.Time. A
+// timestamp of 0 results in the zero value.
+func dataTime(v interface{}) (time.Time, error) {
+	var secs int64
+	switch t := v.(type) {
+	case json.Number:
+		var err error
+		if secs, err = t.Int64(); err != nil {
+			return time.Time{}, err
+		}
+	case float64:
+		secs = int64(t)
+	case int64:
+		secs = t
+	case int:
+		secs = int64(t)
+	case nil:
+		return time.Time{}, nil
+	default:
+		return time.Time{}, fmt.Errorf("unexpected timestamp value %v", v)
+	}
+	if secs == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// readCertRecord reads the cert with the given serial number from the mount.
+func readCertRecord(mount, serial string) (*certRecord, error) {
+	readPath := fmt.Sprintf("%s/cert/%s", mount, serial)
+	certSecret, err := vaultAPI.Read(vaultAPI.Client(), readPath)
+	if err != nil {
+		return nil, err
+	}
+	if certSecret == nil || certSecret.Data == nil {
+		return nil, fmt.Errorf("read of %s returned no data", readPath)
+	}
+	contents, ok := certSecret.Data["certificate"].(string)
+	if !ok {
+		return nil, fmt.Errorf("read of %s returned no certificate", readPath)
+	}
+	cert, err := parseCertPEM(contents)
+	if err != nil {
+		return nil, err
+	}
+	revokedAt, err := dataTime(certSecret.Data["revocation_time"])
+	if err != nil {
+		return nil, err
+	}
+	return &certRecord{
+		serial:    formatSerial(cert.SerialNumber),
+		cert:      cert,
+		revokedAt: revokedAt,
+	}, nil
+}
+
+// listSerials returns the serial numbers of the certs stored in the mount.
+// Vault lists them with dashes instead of colons, so they're converted to the
+// format used everywhere else.
+func listSerials(mount string) ([]string, error) {
+	listSecret, err := vaultAPI.Client().Logical().List(fmt.Sprintf("%s/certs", mount))
+	if err != nil {
+		return nil, err
+	}
+	if listSecret == nil || listSecret.Data == nil {
+		return nil, nil
+	}
+	var serials []string
+	for _, s := range dataStrings(listSecret.Data["keys"]) {
+		serials = append(serials, strings.Replace(s, "-", ":", -1))
+	}
+	return serials, nil
+}
+
+// readCertRecords reads the certs with the given serial numbers from the mount
+// using at most workers concurrent requests. The records are returned in the
+// same order as the serial numbers. No more reads are started once one fails.
+func readCertRecords(mount string, serials []string, workers int) ([]*certRecord, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	records := make([]*certRecord, len(serials))
+	indexes := make(chan int)
+	failed := make(chan struct{})
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				record, err := readCertRecord(mount, serials[idx])
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("error reading cert %s: %s", serials[idx], err)
+						close(failed)
+					}
+					mu.Unlock()
+					continue
+				}
+				records[idx] = record
+			}
+		}()
+	}
+dispatch:
+	for idx := range serials {
+		select {
+		case indexes <- idx:
+		case <-failed:
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return records, nil
+}
+
+// listCertRecords reads all of the certs stored in the mount using at most
+// workers concurrent requests.
+func listCertRecords(mount string, workers int) ([]*certRecord, error) {
+	serials, err := listSerials(mount)
+	if err != nil {
+		return nil, err
+	}
+	return readCertRecords(mount, serials, workers)
+}
+
+// revokeSerial revokes the cert with the given serial number in the mount and
+// returns the revocation time.
+func revokeSerial(mount, serial string) (time.Time, error) {
+	revokeSecret, err := vaultAPI.Write(vaultAPI.Client(), fmt.Sprintf("%s/revoke", mount), map[string]interface{}{
+		"serial_number": serial,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if revokeSecret == nil {
+		return time.Time{}, errors.New("revoke returned nil")
+	}
+	if revokeSecret.Data == nil {
+		return time.Time{}, errors.New("revoke returned no data")
+	}
+	if _, ok := revokeSecret.Data["revocation_time"]; !ok {
+		return time.Time{}, errors.New("failed to get the revocation time")
+	}
+	rtime, err := dataTime(revokeSecret.Data["revocation_time"])
+	if err != nil {
+		return time.Time{}, err
+	}
+	if rtime.IsZero() {
+		return time.Time{}, errors.New("revocation time was 0")
+	}
+	return rtime, nil
+}
+
+// rotateCRL forces the mount to rebuild its CRL.
+func rotateCRL(mount string) error {
+	_, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/crl/rotate", mount))
+	return err
+}
+
+// readSerialsFile reads serial numbers from a file containing one serial
+// number per line. Blank lines and lines starting with # are ignored.
+func readSerialsFile(p string) ([]string, error) {
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var serials []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		serials = append(serials, strings.Replace(line, "-", ":", -1))
+	}
+	return serials, nil
+}
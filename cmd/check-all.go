@@ -0,0 +1,619 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cyverse-de/vaulter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// The statuses reported by 'check all'.
+const (
+	checkOK    = "OK"
+	checkDrift = "DRIFT"
+	checkError = "ERROR"
+)
+
+// checkResult is the outcome of one of the checks run by 'check all'.
+type checkResult struct {
+	name     string
+	status   string
+	details  []string
+	remedies []string
+}
+
+// newCheckResult returns a *checkResult for the named check that hasn't found
+// anything wrong yet.
+func newCheckResult(name string) *checkResult {
+	return &checkResult{name: name, status: checkOK}
+}
+
+// drift records a difference between Vault and the desired state along with
+// the command that would fix it.
+func (r *checkResult) drift(detail, remedy string) {
+	if r.status == checkOK {
+		r.status = checkDrift
+	}
+	r.details = append(r.details, detail)
+	for _, existing := range r.remedies {
+		if existing == remedy {
+			return
+		}
+	}
+	r.remedies = append(r.remedies, remedy)
+}
+
+// fail records an error that kept the check from finishing.
+func (r *checkResult) fail(err error) *checkResult {
+	r.status = checkError
+	r.details = append(r.details, err.Error())
+	return r
+}
+
+// checkKinds are the checks that can be described in the check section of the
+// config file, in the order that they're reported in. Each returns the 'check'
+// command whose flags describe it and the function that runs it.
+var checkKinds = []struct {
+	name  string
+	build func() (*cobra.Command, func() *checkResult)
+}{
+	{"root-ca", func() (*cobra.Command, func() *checkResult) {
+		r := NewRootCA()
+		return r.Check, r.evaluate
+	}},
+	{"intermediate-ca", func() (*cobra.Command, func() *checkResult) {
+		i := NewIntermediateCA()
+		return i.Check, i.evaluate
+	}},
+	{"role", func() (*cobra.Command, func() *checkResult) {
+		r := NewRole()
+		return r.Check, r.evaluate
+	}},
+	{"tls", func() (*cobra.Command, func() *checkResult) {
+		t := NewTLSGen()
+		return t.Check, t.evaluate
+	}},
+}
+
+// CheckAll contains the command for running every check described in the
+// config file.
+type CheckAll struct {
+	All *cobra.Command
+}
+
+// NewCheckAll returns a newly instantiated *CheckAll.
+func NewCheckAll() *CheckAll {
+	c := &CheckAll{
+		All: &cobra.Command{
+			Use:   "all",
+			Short: "Runs every check described in the config file.",
+			Long: `Runs every check described in the check section of the file at --config
+concurrently and reports the results together. Each check takes the same
+settings as the flags of its 'check' command, and a section can describe a
+single check or a list of them:
+
+  check:
+    root-ca:
+      common-name: DE Root CA
+    intermediate-ca:
+      common-name: DE Intermediate CA
+    role:
+      - role: de
+        allowed-domain: [example.org]
+        allow-subdomains: true
+    tls:
+      - cert-path: /etc/ssl/de/server.pem
+        min-remaining: 720h
+      - manifest-path: k8s/de-tls.yaml
+
+Settings that aren't given for a check are looked up the same way as they are
+for its 'check' command, including from the active context. Each check is
+reported as OK, DRIFT if Vault or the cert differs from what is described, or
+ERROR if the check couldn't be completed. The command that would fix each
+drifted check is listed afterwards. Exits with 0 if every check is OK, 2 if any
+drifted, and 1 if any failed.`,
+		},
+	}
+
+	c.All.Run = c.allRun
+
+	return c
+}
+
+// shellQuote quotes the argument for the shell if it needs to be. Placeholders
+// like <file> are left alone.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") {
+		return s
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=,@%+", r) {
+			return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+		}
+	}
+	return s
+}
+
+// commandLine returns the de-vault command line that runs the command at path
+// with the given arguments.
+func commandLine(path string, args ...string) string {
+	words := []string{"de-vault", path}
+	for _, a := range args {
+		words = append(words, shellQuote(a))
+	}
+	return strings.Join(words, " ")
+}
+
+// changedFlags returns the named flags of c that were set, whether on the
+// command line, in the environment, or in --config, as arguments that set them
+// to the same values. Flags without a value are left out.
+func changedFlags(c *cobra.Command, names ...string) []string {
+	var args []string
+	for _, name := range names {
+		f := c.PersistentFlags().Lookup(name)
+		if f == nil || !f.Changed {
+			continue
+		}
+		value := f.Value.String()
+		switch f.Value.Type() {
+		case "bool":
+			if value == "true" {
+				args = append(args, "--"+f.Name)
+			} else {
+				args = append(args, fmt.Sprintf("--%s=%s", f.Name, value))
+			}
+			continue
+		case "stringSlice":
+			value = strings.Trim(value, "[]")
+		}
+		if value != "" {
+			args = append(args, "--"+f.Name, value)
+		}
+	}
+	return args
+}
+
+// evaluate compares the root CA in Vault against the settings without
+// printing anything.
+func (r *RootCA) evaluate() *checkResult {
+	res := newCheckResult("root-ca " + r.mount)
+	if r.mount == "" || r.role == "" || r.commonName == "" {
+		return res.fail(errors.New("mount, role, and common-name must be set"))
+	}
+	if err := r.keys.validate(); err != nil {
+		return res.fail(err)
+	}
+	ttl, err := parseTTL(r.ttl)
+	if err != nil {
+		return res.fail(err)
+	}
+
+	initArgs := []string{"--mount", r.mount, "--role", r.role, "--common-name", r.commonName}
+	initArgs = append(initArgs, changedFlags(r.Check, "key-type", "key-bits", "ttl")...)
+	initRoot := commandLine("init root-ca", initArgs...)
+
+	hasRoot, err := vaulter.IsMounted(vaultAPI, r.mount)
+	if err != nil {
+		return res.fail(err)
+	}
+	if !hasRoot {
+		res.drift("backend is not mounted", initRoot)
+		return res
+	}
+
+	hasRole, err := vaulter.HasRole(vaultAPI, r.mount, r.role, r.commonName, true)
+	if err != nil {
+		return res.fail(err)
+	}
+	if !hasRole {
+		res.drift(fmt.Sprintf("role %s does not exist", r.role), initRoot)
+	}
+
+	caCert, err := readCACert(vaultAPI, r.mount)
+	if err != nil {
+		return res.fail(err)
+	}
+	if caCert == nil {
+		res.drift("cert does not exist", initRoot)
+		return res
+	}
+	chain, err := readImportedChain(r.mount)
+	if err != nil {
+		return res.fail(err)
+	}
+	if diffs := rootCertDifferences(caCert, chain, r.commonName, &r.keys, ttl); len(diffs) > 0 {
+		res.drift(
+			fmt.Sprintf("cert does not match the requested settings (%s)", strings.Join(diffs, "; ")),
+			commandLine("remove root-ca", "--mount", r.mount)+" && "+initRoot,
+		)
+	}
+	return res
+}
+
+// evaluate compares the intermediate CA in Vault against the settings without
+// printing anything.
+func (i *IntermediateCA) evaluate() *checkResult {
+	res := newCheckResult("intermediate-ca " + i.mount)
+	if i.mount == "" || i.role == "" || i.commonName == "" {
+		return res.fail(errors.New("mount, role, and common-name must be set"))
+	}
+
+	initArgs := []string{"--mount", i.mount, "--role", i.role, "--common-name", i.commonName}
+	initArgs = append(initArgs, changedFlags(i.Check, "root-mount", "base-url")...)
+	importArgs := []string{"--mount", i.mount, "--cert", "<signed cert>"}
+	importArgs = append(importArgs, changedFlags(i.Check, "base-url")...)
+	urlsArgs := []string{"--mount", i.mount, "--urls-only"}
+	urlsArgs = append(urlsArgs, changedFlags(i.Check, "base-url")...)
+	rotateArgs := []string{"--mount", i.mount, "--new-mount", "<new mount>"}
+	rotateArgs = append(rotateArgs, changedFlags(i.Check, "root-mount", "base-url")...)
+
+	hasIntermediate, err := vaulter.IsMounted(vaultAPI, i.mount)
+	if err != nil {
+		return res.fail(err)
+	}
+	if !hasIntermediate {
+		res.drift("backend is not mounted", commandLine("init intermediate-ca", initArgs...))
+		return res
+	}
+
+	hasRole, err := vaulter.HasRole(vaultAPI, i.mount, i.role, i.commonName, true)
+	if err != nil {
+		return res.fail(err)
+	}
+	if !hasRole {
+		res.drift(
+			fmt.Sprintf("role %s does not exist", i.role),
+			commandLine("init role", "--mount", i.mount, "--role", i.role, "--allowed-domain", i.commonName, "--allow-subdomains"),
+		)
+	}
+
+	caCert, err := readCACert(vaultAPI, i.mount)
+	if err != nil {
+		return res.fail(err)
+	}
+	if caCert == nil {
+		res.drift(
+			"cert has not been imported (CSR pending or 'init intermediate-ca' failed midway)",
+			commandLine("import intermediate-ca", importArgs...),
+		)
+		return res
+	}
+
+	chain, err := readImportedChain(i.mount)
+	if err != nil {
+		return res.fail(err)
+	}
+	var rootCert *x509.Certificate
+	if i.rootMount != "" {
+		if rootCert, err = readCACert(vaultAPI, i.rootMount); err != nil {
+			return res.fail(err)
+		}
+	}
+	if rootCert == nil && len(chain) > 0 && chain[len(chain)-1].CheckSignatureFrom(chain[len(chain)-1]) == nil {
+		rootCert = chain[len(chain)-1]
+	}
+	if rootCert == nil {
+		return res.fail(errors.New("no root CA cert to verify the intermediate CA cert against"))
+	}
+	if err = verifyAgainst(caCert, []*x509.Certificate{rootCert}, chain...); err != nil {
+		res.drift(
+			fmt.Sprintf("cert is not signed by the root CA (%s)", err),
+			commandLine("rotate intermediate-ca", rotateArgs...),
+		)
+	}
+
+	configured, err := i.urlsConfigured(i.mount)
+	if err != nil {
+		return res.fail(err)
+	}
+	if !configured {
+		res.drift("CA and CRL URLs are not configured", commandLine("init intermediate-ca", urlsArgs...))
+	}
+
+	serials, err := listSerials(i.mount)
+	if err != nil {
+		return res.fail(err)
+	}
+	if len(serials) > i.maxCerts {
+		res.drift(
+			fmt.Sprintf("cert store holds %d certs, more than %d", len(serials), i.maxCerts),
+			commandLine("tidy", "--mount", i.mount),
+		)
+	}
+	return res
+}
+
+// evaluate compares the role in Vault against the settings without printing
+// anything.
+func (r *Role) evaluate() *checkResult {
+	res := newCheckResult(fmt.Sprintf("role %s/%s", r.mount, r.role))
+	if r.mount == "" || r.role == "" {
+		return res.fail(errors.New("mount and role must be set"))
+	}
+	if err := r.validate(); err != nil {
+		return res.fail(err)
+	}
+
+	var names []string
+	r.Check.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		if f.Name != "mount" && f.Name != "role" {
+			names = append(names, f.Name)
+		}
+	})
+	initArgs := []string{"--mount", r.mount, "--role", r.role}
+	initRole := commandLine("init role", append(initArgs, changedFlags(r.Check, names...)...)...)
+
+	roleSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", r.mount, r.role))
+	if err != nil {
+		return res.fail(err)
+	}
+	if roleSecret == nil || roleSecret.Data == nil {
+		res.drift("role does not exist", initRole)
+		return res
+	}
+	if diffs := r.differences(roleSecret.Data); len(diffs) > 0 {
+		res.drift(fmt.Sprintf("settings differ (%s)", strings.Join(diffs, ", ")), initRole)
+	}
+	return res
+}
+
+// evaluate checks the TLS cert against Vault and --min-remaining without
+// printing anything.
+func (t *TLSGen) evaluate() *checkResult {
+	mount := t.mount
+	serial := t.serialNumber
+	var res *checkResult
+	switch {
+	case t.manifestPath != "":
+		res = newCheckResult("tls " + t.manifestPath)
+	case t.certPath != "":
+		res = newCheckResult("tls " + t.certPath)
+	default:
+		res = newCheckResult(fmt.Sprintf("tls %s %s", mount, serial))
+	}
+	if t.serialNumber == "" && t.certPath == "" && t.manifestPath == "" {
+		return res.fail(errors.New("serial-number, cert-path, or manifest-path must be set"))
+	}
+	minRemaining, err := parseTTL(t.minRemaining)
+	if err != nil {
+		return res.fail(err)
+	}
+
+	var local *x509.Certificate
+	if t.manifestPath != "" {
+		secret, err := readTLSSecret(t.manifestPath)
+		if err != nil {
+			return res.fail(err)
+		}
+		if local, err = secret.cert(); err != nil {
+			return res.fail(err)
+		}
+		if !t.Check.Flags().Changed("mount") {
+			if secretMount := secret.Metadata.Annotations[annotationMount]; secretMount != "" {
+				mount = secretMount
+			} else if certMount, err := mountFromCert(local); err == nil {
+				mount = certMount
+			}
+		}
+	} else if t.certPath != "" {
+		contents, err := ioutil.ReadFile(t.certPath)
+		if err != nil {
+			return res.fail(err)
+		}
+		if local, err = parseCertPEM(string(contents)); err != nil {
+			return res.fail(err)
+		}
+		if !t.Check.Flags().Changed("mount") {
+			if certMount, err := mountFromCert(local); err == nil {
+				mount = certMount
+			}
+		}
+	}
+	if local != nil {
+		serial = formatSerial(local.SerialNumber)
+	}
+
+	record, err := readCertRecord(mount, serial)
+	if err != nil {
+		return res.fail(err)
+	}
+	cert := record.cert
+	if local != nil {
+		cert = local
+	}
+
+	renewArgs := changedFlags(t.Check, "mount", "min-remaining")
+	generateArgs := []string{"--mount", mount, "--common-name", cert.Subject.CommonName}
+	var renew string
+	switch {
+	case t.manifestPath != "":
+		renew = commandLine("renew tls", append([]string{"--manifest-path", t.manifestPath}, renewArgs...)...)
+		generateArgs = append(generateArgs, "--output", "k8s-secret", "--manifest-path", t.manifestPath)
+	case t.certPath != "":
+		renew = commandLine("renew tls", append([]string{"--cert-path", t.certPath, "--key-path", "<key file>"}, renewArgs...)...)
+		generateArgs = append(generateArgs, "--cert-path", t.certPath, "--key-path", "<key file>")
+	}
+	generate := commandLine("generate tls", generateArgs...)
+	if renew == "" {
+		renew = generate
+	}
+
+	if local != nil && !bytes.Equal(local.Raw, record.cert.Raw) {
+		res.drift("cert file does not match the cert in Vault", generate)
+	}
+	if record.revoked() {
+		res.drift(fmt.Sprintf("cert was revoked at %s", record.revokedAt.Format(time.RFC3339)), generate)
+	}
+	if time.Now().After(cert.NotAfter) {
+		res.drift(fmt.Sprintf("cert expired at %s", cert.NotAfter.Format(time.RFC3339)), renew)
+	} else if time.Until(cert.NotAfter) < minRemaining {
+		res.drift(fmt.Sprintf("cert expires at %s (%d days remaining)", cert.NotAfter.Format(time.RFC3339), daysRemaining(cert)), renew)
+	}
+
+	caCert, err := readCACert(vaultAPI, mount)
+	if err != nil {
+		return res.fail(err)
+	}
+	if caCert != nil {
+		if err = verifyAgainst(cert, []*x509.Certificate{caCert}); err != nil {
+			res.drift(fmt.Sprintf("chain does not verify against the CA of %s (%s)", mount, err), generate)
+		}
+	}
+	return res
+}
+
+// checkEntries returns the settings for each of the checks of the named kind
+// in the config file. A section can hold the settings for a single check or a
+// list of them.
+func checkEntries(settings map[string]interface{}, kind string) ([]map[string]interface{}, error) {
+	section, ok := settings["check"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	switch t := section[kind].(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return []map[string]interface{}{t}, nil
+	case []interface{}:
+		var entries []map[string]interface{}
+		for _, e := range t {
+			entry, ok := normalizeConfig(e).(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("check.%s must be a map or a list of maps", kind)
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}
+	return nil, fmt.Errorf("check.%s must be a map or a list of maps", kind)
+}
+
+// readChecks reads the check section of the file at --config and returns the
+// functions that run the checks described in it.
+func readChecks() []func() *checkResult {
+	if configPath == "" {
+		log.Fatal("--config must be set.")
+	}
+	settings, err := readConfigFile()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var checks []func() *checkResult
+	for _, kind := range checkKinds {
+		entries, err := checkEntries(settings, kind.name)
+		if err != nil {
+			log.Fatalf("%s in %s", err, configPath)
+		}
+		for idx, entry := range entries {
+			c, check := kind.build()
+
+			// Attach the command to stand-ins for its parents so that the
+			// settings missing from the entry are looked up in the same
+			// sections of the config file as they are for 'check <kind>'.
+			root := &cobra.Command{Use: RootCmd.Use}
+			parent := &cobra.Command{Use: checkCmd.Use}
+			root.AddCommand(parent)
+			parent.AddCommand(c)
+
+			if err = setFlags(c, entry); err == nil {
+				if err = c.ParseFlags(nil); err == nil {
+					err = applyConfig(c)
+				}
+			}
+			if err == nil && currentContext != nil {
+				err = currentContext.apply(c)
+			}
+			if err == nil && kind.name != "root-ca" {
+				f := c.Flags().Lookup("mount")
+				var mount string
+				if mount, _, err = tlsMount(c, f.Value.String()); err == nil {
+					err = f.Value.Set(mount)
+				}
+			}
+			if err != nil {
+				log.Fatalf("check.%s entry %d in %s: %s", kind.name, idx+1, configPath, err)
+			}
+			checks = append(checks, check)
+		}
+	}
+	if len(checks) == 0 {
+		log.Fatalf("no checks are described in %s", configPath)
+	}
+	return checks
+}
+
+func (c *CheckAll) allRun(cmd *cobra.Command, args []string) {
+	checks := readChecks()
+
+	results := make([]*checkResult, len(checks))
+	var wg sync.WaitGroup
+	for idx, check := range checks {
+		wg.Add(1)
+		go func(idx int, check func() *checkResult) {
+			defer wg.Done()
+			results[idx] = check()
+		}(idx, check)
+	}
+	wg.Wait()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	var remedies int
+	counts := map[string]int{}
+	fmt.Fprint(w, "CHECK\tSTATUS\tDETAILS\t\n")
+	for _, r := range results {
+		counts[r.status]++
+		remedies += len(r.remedies)
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", r.name, r.status, strings.Join(r.details, "; "))
+	}
+
+	if remedies > 0 {
+		fmt.Fprint(w, "\nCHECK\tREMEDIATION\t\n")
+		for _, r := range results {
+			for idx, remedy := range r.remedies {
+				name := r.name
+				if idx > 0 {
+					name = ""
+				}
+				fmt.Fprintf(w, "%s\t%s\t\n", name, remedy)
+			}
+		}
+	}
+
+	fmt.Fprintf(
+		w,
+		"\n%d ok, %d drifted, %d failed\t\n",
+		counts[checkOK],
+		counts[checkDrift],
+		counts[checkError],
+	)
+	w.Flush()
+
+	switch {
+	case counts[checkError] > 0:
+		os.Exit(1)
+	case counts[checkDrift] > 0:
+		os.Exit(pendingChangesExitCode)
+	}
+}
+
+func init() {
+	c := NewCheckAll()
+	checkCmd.AddCommand(c.All)
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var (
+	configPath   string          // Path to a YAML, TOML, or HCL file with flag values.
+	fromVaultEnv map[string]bool // The flags that were set from the Vault CLI's environment variables.
+)
+
+// envPrefix is prepended to flag names to get the environment variables that
+// set them, e.g. DE_VAULT_MOUNT or DE_VAULT_GENERATE_TLS_MOUNT.
+const envPrefix = "de_vault"
+
+// vaultEnv maps the global flags to the environment variables used by the
+// Vault CLI, so that an environment set up for 'vault' also works here.
+var vaultEnv = map[string]string{
+	"api-url":     "VAULT_ADDR",
+	"token":       "VAULT_TOKEN",
+	"ca-cert":     "VAULT_CACERT",
+	"client-cert": "VAULT_CLIENT_CERT",
+	"client-key":  "VAULT_CLIENT_KEY",
+}
+
+// configSections returns the config sections that apply to the command, from
+// the most specific to the least. 'de-vault generate tls' reads its settings
+// from the generate.tls section, then the generate section, then the top
+// level of the config file.
+func configSections(cmd *cobra.Command) []string {
+	var sections []string
+	for c := cmd; c.HasParent(); c = c.Parent() {
+		path := strings.Fields(c.CommandPath())[1:]
+		sections = append(sections, strings.Join(path, "."))
+	}
+	return append(sections, "")
+}
+
+// sectionKey returns the key for the flag within the config section.
+func sectionKey(section, name string) string {
+	if section == "" {
+		return name
+	}
+	return section + "." + name
+}
+
+// normalizeConfig merges the lists of maps that the HCL decoder produces for
+// blocks into plain maps, so that all of the supported formats can be looked
+// up the same way.
+func normalizeConfig(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, val := range t {
+			out[strings.ToLower(k)] = normalizeConfig(val)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := map[string]interface{}{}
+		for k, val := range t {
+			out[strings.ToLower(fmt.Sprint(k))] = normalizeConfig(val)
+		}
+		return out
+	case []map[string]interface{}:
+		out := map[string]interface{}{}
+		for _, m := range t {
+			for k, val := range normalizeConfig(m).(map[string]interface{}) {
+				out[k] = val
+			}
+		}
+		return out
+	}
+	return v
+}
+
+// lookupConfig returns the value at the dotted key in the normalized config.
+// Sections, whether a single map or a list of them, aren't flag values and
+// aren't returned.
+func lookupConfig(settings map[string]interface{}, key string) (interface{}, bool) {
+	var value interface{} = settings
+	for _, part := range strings.Split(key, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	switch t := value.(type) {
+	case map[string]interface{}:
+		return nil, false
+	case []interface{}:
+		for _, v := range t {
+			if _, ok := normalizeConfig(v).(map[string]interface{}); ok {
+				return nil, false
+			}
+		}
+	}
+	return value, true
+}
+
+// flagString converts a value from the config file into the string form that
+// the flag parses. Lists become comma-separated values.
+func flagString(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		var parts []string
+		for _, v := range list {
+			parts = append(parts, fmt.Sprint(v))
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// readConfigFile reads the file at --config. An empty map is returned if
+// --config isn't set.
+func readConfigFile() (map[string]interface{}, error) {
+	if configPath == "" {
+		return map[string]interface{}{}, nil
+	}
+	file := viper.New()
+	file.SetConfigFile(configPath)
+	if err := file.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", configPath, err)
+	}
+	return normalizeConfig(file.AllSettings()).(map[string]interface{}), nil
+}
+
+// applyConfig sets the flags of the command that weren't passed on the command
+// line from the environment, then from the file at --config. Flags set this way
+// are treated the same as flags passed on the command line, so the defaults
+// that are looked up in Vault don't override them. The flags set from the Vault
+// CLI's environment variables are recorded in fromVaultEnv, since the active
+// context's connection settings take precedence over them.
+func applyConfig(cmd *cobra.Command) error {
+	fromVaultEnv = map[string]bool{}
+	env := viper.New()
+	env.SetEnvPrefix(envPrefix)
+	env.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
+	env.AutomaticEnv()
+	for name, envVar := range vaultEnv {
+		if err := env.BindEnv(name, envVar); err != nil {
+			return err
+		}
+	}
+
+	settings, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+
+	sections := configSections(cmd)
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Name == "config" || f.Name == "help" {
+			return
+		}
+		for _, s := range sections {
+			key := sectionKey(s, f.Name)
+			if env.IsSet(key) {
+				if err = cmd.Flags().Set(f.Name, env.GetString(key)); err != nil {
+					err = fmt.Errorf("invalid value in the environment for --%s: %s", f.Name, err)
+				}
+				fromVaultEnv[f.Name] = s == "" && vaultEnv[f.Name] != ""
+				return
+			}
+		}
+		for _, s := range sections {
+			key := sectionKey(s, f.Name)
+			if value, ok := lookupConfig(settings, key); ok {
+				if err = cmd.Flags().Set(f.Name, flagString(value)); err != nil {
+					err = fmt.Errorf("invalid value for %s in %s: %s", key, configPath, err)
+				}
+				return
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,431 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// destructiveAnnotation marks the commands that remove or replace things in
+// Vault. They show the active context before running and ask for an extra
+// confirmation if it's protected. The value is either "true", or the name of
+// the flag that makes the command destructive when it's set, e.g. "revoke-old".
+const destructiveAnnotation = "de-vault.cyverse.org/destructive"
+
+var (
+	contextName    string        // The context to use instead of the current one.
+	currentContext *vaultContext // The active context, if there is one.
+)
+
+// vaultContext contains the settings for connecting to the Vault instance of a
+// single DE deployment, along with the mounts used there.
+type vaultContext struct {
+	Name       string `yaml:"name"`
+	APIURL     string `yaml:"api-url,omitempty"`
+	TokenFile  string `yaml:"token-file,omitempty"`
+	TokenEnv   string `yaml:"token-env,omitempty"`
+	CACert     string `yaml:"ca-cert,omitempty"`
+	ClientCert string `yaml:"client-cert,omitempty"`
+	ClientKey  string `yaml:"client-key,omitempty"`
+	RootMount  string `yaml:"root-mount,omitempty"`
+	Mount      string `yaml:"mount,omitempty"`
+	Protected  bool   `yaml:"protected,omitempty"`
+
+	// RotatedFrom lists the intermediate CA mounts that 'rotate
+	// intermediate-ca' switched away from.
+	RotatedFrom []string `yaml:"rotated-from,omitempty"`
+}
+
+// contextConfig is the local file listing the contexts and which of them is
+// the current one.
+type contextConfig struct {
+	Current  string          `yaml:"current-context,omitempty"`
+	Contexts []*vaultContext `yaml:"contexts"`
+}
+
+// contextConfigPath returns the path to the file containing the contexts.
+func contextConfigPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".de-vault", "contexts.yaml")
+}
+
+// readContextConfig reads the contexts. A missing file results in an empty
+// *contextConfig rather than an error.
+func readContextConfig() (*contextConfig, error) {
+	c := &contextConfig{}
+	contents, err := ioutil.ReadFile(contextConfigPath())
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(contents, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// writeContextConfig writes out the contexts, creating the parent directory if
+// necessary.
+func writeContextConfig(c *contextConfig) error {
+	p := contextConfigPath()
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	contents, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFilesAtomic(&outputFile{path: p, contents: contents, perm: 0600})
+}
+
+// lookup returns the named context, or nil if there isn't one.
+func (c *contextConfig) lookup(name string) *vaultContext {
+	for _, ctx := range c.Contexts {
+		if ctx.Name == name {
+			return ctx
+		}
+	}
+	return nil
+}
+
+// activeContext returns the context named by --context, or the current context
+// if --context isn't set. Returns nil if neither is set.
+func activeContext() (*vaultContext, error) {
+	c, err := readContextConfig()
+	if err != nil {
+		return nil, err
+	}
+	name := contextName
+	if name == "" {
+		name = c.Current
+	}
+	if name == "" {
+		return nil, nil
+	}
+	ctx := c.lookup(name)
+	if ctx == nil {
+		return nil, fmt.Errorf("context %s does not exist", name)
+	}
+	return ctx, nil
+}
+
+// token reads the Vault token from the context's token source.
+func (v *vaultContext) token() (string, error) {
+	switch {
+	case v.TokenFile != "":
+		contents, err := ioutil.ReadFile(v.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(contents)), nil
+	case v.TokenEnv != "":
+		return os.Getenv(v.TokenEnv), nil
+	}
+	return "", nil
+}
+
+// apply fills in the flags of the command that weren't set on the command
+// line, in the environment, or in --config with the context's settings. The
+// flags aren't marked as changed, so the context's settings act as defaults.
+// The connection settings also replace the ones taken from the Vault CLI's
+// environment variables, e.g. VAULT_ADDR, since those are usually left over
+// from working with some other Vault instance. The --mount flag of the root CA
+// commands is set to the context's root CA mount. The context's intermediate CA
+// mount is resolved by tlsMount in the commands that use an intermediate CA
+// rather than here, so that the commands that remove or replace an
+// intermediate CA never default to the one in use.
+func (v *vaultContext) apply(cmd *cobra.Command) error {
+	settings := map[string]string{
+		"api-url":     v.APIURL,
+		"ca-cert":     v.CACert,
+		"client-cert": v.ClientCert,
+		"client-key":  v.ClientKey,
+		"root-mount":  v.RootMount,
+	}
+	if cmd.Name() == "root-ca" {
+		settings["mount"] = v.RootMount
+	}
+	if f := cmd.Flags().Lookup("token"); f != nil && (!f.Changed || fromVaultEnv[f.Name]) {
+		token, err := v.token()
+		if err != nil {
+			return fmt.Errorf("error reading the token for context %s: %s", v.Name, err)
+		}
+		settings["token"] = token
+	}
+	for name, value := range settings {
+		f := cmd.Flags().Lookup(name)
+		if f == nil || (f.Changed && !fromVaultEnv[name]) || value == "" {
+			continue
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid value for %s in context %s: %s", name, v.Name, err)
+		}
+	}
+	return nil
+}
+
+// isDestructive returns true if the command removes or replaces things in
+// Vault with the flags it was given, according to its destructiveAnnotation.
+func isDestructive(cmd *cobra.Command) bool {
+	switch value := cmd.Annotations[destructiveAnnotation]; value {
+	case "":
+		return false
+	case "true":
+		return true
+	default:
+		f := cmd.Flags().Lookup(value)
+		return f != nil && f.Value.String() != f.DefValue
+	}
+}
+
+// confirmContext shows the active context before a destructive command runs
+// and, if the context is protected, exits unless the user confirms by typing
+// its name. Nothing is asked during a dry run since nothing is changed.
+func confirmContext(cmd *cobra.Command) {
+	if currentContext == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\n*** Context: %s (%s) ***\n\n", currentContext.Name, vaultURL)
+	if !currentContext.Protected {
+		return
+	}
+	if f := cmd.Flags().Lookup("dry-run"); f != nil && f.Value.String() == "true" {
+		return
+	}
+	prompt := fmt.Sprintf("Context %s is protected. Type its name to run '%s' against it", currentContext.Name, cmd.CommandPath())
+	if !confirmTyped(prompt, currentContext.Name) {
+		log.Fatal("Aborted.")
+	}
+}
+
+var contextCmd = &cobra.Command{
+	Use:   "context",
+	Short: "Manages the contexts for the DE deployments' Vault instances.",
+	Long: `Manages contexts, which hold the settings for connecting to the Vault
+instance of a DE deployment along with the mounts used there. The active
+context is the one named by --context, or the current context set with 'context
+use'. Its settings are used for the flags that aren't set on the command line,
+in the environment, or in --config. The intermediate CA mount is the default
+--mount of every command that uses an intermediate CA, except the commands
+that init, import, rotate, or remove an intermediate CA and 'remove role',
+which take --mount as usual.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if dryRun {
+			log.Fatalf("--dry-run is not supported by '%s'.", cmd.CommandPath())
+		}
+	},
+}
+
+// Context contains the commands for managing contexts.
+type Context struct {
+	ctx  vaultContext
+	Add  *cobra.Command
+	Use  *cobra.Command
+	List *cobra.Command
+}
+
+// NewContext returns a newly instantiated *Context.
+func NewContext() *Context {
+	c := &Context{
+		Add: &cobra.Command{
+			Use:   "add NAME",
+			Short: "Adds a context.",
+			Long: `Adds a context named NAME with the settings given by the flags, replacing
+any existing context with the same name. The token is read when the context is
+used, from the file at --token-file or the environment variable named by
+--token-env, so that it isn't stored along with the context. Commands that
+remove or replace things in Vault ask for the name of a context added with
+--protected to be typed before running against it.`,
+		},
+		Use: &cobra.Command{
+			Use:   "use NAME",
+			Short: "Sets the current context.",
+			Long: `Sets the context named NAME as the current context, which is used by
+every command that isn't given --context.`,
+		},
+		List: &cobra.Command{
+			Use:   "list",
+			Short: "Lists the contexts.",
+			Long: `Lists the contexts along with their Vault API URLs, token sources, mounts,
+and whether they're protected. The current context is marked with a *.`,
+		},
+	}
+
+	c.Add.Run = c.addRun
+	c.Use.Run = c.useRun
+	c.List.Run = c.listRun
+
+	c.Add.PersistentFlags().StringVar(
+		&c.ctx.APIURL,
+		"api-url",
+		"",
+		"The URL for the Vault API.",
+	)
+	c.Add.PersistentFlags().StringVar(
+		&c.ctx.TokenFile,
+		"token-file",
+		"",
+		"The path to a file containing the Vault token.",
+	)
+	c.Add.PersistentFlags().StringVar(
+		&c.ctx.TokenEnv,
+		"token-env",
+		"",
+		"The name of the environment variable containing the Vault token.",
+	)
+	c.Add.PersistentFlags().StringVar(
+		&c.ctx.CACert,
+		"ca-cert",
+		"",
+		"The CA cert used to verify the Vault server's TLS cert.",
+	)
+	c.Add.PersistentFlags().StringVar(
+		&c.ctx.ClientCert,
+		"client-cert",
+		"",
+		"The client TLS certificate to use for the Vault connection.",
+	)
+	c.Add.PersistentFlags().StringVar(
+		&c.ctx.ClientKey,
+		"client-key",
+		"",
+		"The client key to use for TLS connection to the Vault API.",
+	)
+	c.Add.PersistentFlags().StringVar(
+		&c.ctx.RootMount,
+		"root-mount",
+		"",
+		"The path in Vault to the root CA pki backend.",
+	)
+	c.Add.PersistentFlags().StringVar(
+		&c.ctx.Mount,
+		"mount",
+		"",
+		"The path in Vault to the intermediate CA pki backend that the TLS cert, role, and CRL commands use.",
+	)
+	c.Add.PersistentFlags().BoolVar(
+		&c.ctx.Protected,
+		"protected",
+		false,
+		"Ask for the context's name to be typed before removing or replacing things in Vault.",
+	)
+
+	return c
+}
+
+func (c *Context) addRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("A context name must be given.")
+	}
+	if c.ctx.APIURL == "" {
+		log.Fatal("--api-url must be set.")
+	}
+	if c.ctx.TokenFile != "" && c.ctx.TokenEnv != "" {
+		log.Fatal("Only one of --token-file and --token-env may be set.")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Adding the context:\t")
+	config, err := readContextConfig()
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	ctx := c.ctx
+	ctx.Name = args[0]
+	if existing := config.lookup(ctx.Name); existing != nil {
+		*existing = ctx
+	} else {
+		config.Contexts = append(config.Contexts, &ctx)
+	}
+	if err = writeContextConfig(config); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+	w.Flush()
+}
+
+func (c *Context) useRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("A context name must be given.")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Switching the current context:\t")
+	config, err := readContextConfig()
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if config.lookup(args[0]) == nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, fmt.Errorf("context %s does not exist", args[0]))
+	}
+	config.Current = args[0]
+	if err = writeContextConfig(config); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+	w.Flush()
+}
+
+func (c *Context) listRun(cmd *cobra.Command, args []string) {
+	config, err := readContextConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(config.Contexts) == 0 {
+		log.Fatal("No contexts have been added.")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "CURRENT\tNAME\tAPI URL\tTOKEN\tROOT MOUNT\tMOUNT\tPROTECTED\t\n")
+	for _, ctx := range config.Contexts {
+		current := ""
+		if ctx.Name == config.Current {
+			current = "*"
+		}
+		token := ""
+		switch {
+		case ctx.TokenFile != "":
+			token = "file " + ctx.TokenFile
+		case ctx.TokenEnv != "":
+			token = "env " + ctx.TokenEnv
+		}
+		protected := "NO"
+		if ctx.Protected {
+			protected = "YES"
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			current,
+			ctx.Name,
+			ctx.APIURL,
+			token,
+			ctx.RootMount,
+			ctx.Mount,
+			protected,
+		)
+	}
+	w.Flush()
+}
+
+func init() {
+	c := NewContext()
+	RootCmd.AddCommand(contextCmd)
+	contextCmd.AddCommand(c.Add, c.Use, c.List)
+}
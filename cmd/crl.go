@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var crlCmd = &cobra.Command{
+	Use:   "crl",
+	Short: "Manages the certificate revocation list of a PKI backend.",
+	Long:  `Manages the certificate revocation list of a PKI backend.`,
+}
+
+// CRL contains the commands for managing the certificate revocation list of a
+// PKI backend.
+type CRL struct {
+	mount  string
+	expiry string
+	Rotate *cobra.Command
+	Config *cobra.Command
+	Show   *cobra.Command
+	Verify *cobra.Command
+}
+
+// NewCRL returns a newly instantiated *CRL.
+func NewCRL() *CRL {
+	c := &CRL{
+		Rotate: &cobra.Command{
+			Use:         "rotate",
+			Short:       "Forces a rebuild of the CRL.",
+			Annotations: map[string]string{destructiveAnnotation: "true"},
+			Long:        "Forces a rebuild of the CRL for the PKI backend at --mount.",
+		},
+		Config: &cobra.Command{
+			Use:         "config",
+			Short:       "Configures the CRL.",
+			Annotations: map[string]string{destructiveAnnotation: "expiry"},
+			Long: `Sets the expiry of the CRL for the PKI backend at --mount. Reports the
+current expiry if --expiry is not set.`,
+		},
+		Show: &cobra.Command{
+			Use:   "show",
+			Short: "Lists the certs in the CRL.",
+			Long: `Fetches the CRL for the PKI backend at --mount and lists the serial
+numbers and revocation times of the revoked certs in it.`,
+		},
+		Verify: &cobra.Command{
+			Use:   "verify",
+			Short: "Verifies the CRL.",
+			Long: `Fetches the CRL for the PKI backend at --mount and verifies that it was
+signed by the backend's CA cert and that it hasn't passed its next update time.`,
+		},
+	}
+
+	c.Rotate.Run = c.rotateRun
+	c.Config.Run = c.configRun
+	c.Show.Run = c.showRun
+	c.Verify.Run = c.verifyRun
+
+	crlCmd.PersistentFlags().StringVar(
+		&c.mount,
+		"mount",
+		defaultIntMount,
+		"The path in Vault to the PKI backend.",
+	)
+	c.Config.PersistentFlags().StringVar(
+		&c.expiry,
+		"expiry",
+		"",
+		"The amount of time the generated CRL should be valid, e.g. 72h.",
+	)
+
+	return c
+}
+
+// fetchCRL retrieves and parses the DER-encoded CRL for the mount. The CRL
+// endpoint doesn't return JSON, so the logical client can't be used.
+func fetchCRL(mount string) (*pkix.CertificateList, error) {
+	client := vaultAPI.Client()
+	req := client.NewRequest("GET", fmt.Sprintf("/v1/%s/crl", mount))
+	resp, err := client.RawRequest(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(der) == 0 {
+		return nil, fmt.Errorf("%s does not have a CRL", mount)
+	}
+	return x509.ParseDERCRL(der)
+}
+
+func (c *CRL) rotateRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, c.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.mount = mount
+	if c.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Rebuilding the CRL:\t")
+	if err := rotateCRL(c.mount); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+	w.Flush()
+}
+
+func (c *CRL) configRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, c.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.mount = mount
+	if c.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+	configPath := fmt.Sprintf("%s/config/crl", c.mount)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	if c.expiry != "" {
+		if _, err := parseTTL(c.expiry); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprint(w, "Setting the CRL expiry:\t")
+		_, err := vaultAPI.Write(vaultAPI.Client(), configPath, map[string]interface{}{
+			"expiry": c.expiry,
+		})
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+
+	fmt.Fprint(w, "CRL expiry:\t")
+	configSecret, err := vaultAPI.Read(vaultAPI.Client(), configPath)
+	if err != nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+		FatalFlush(w, err)
+	}
+	if configSecret == nil || configSecret.Data == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		fmt.Fprintf(w, "%v\t\n", configSecret.Data["expiry"])
+	}
+	w.Flush()
+}
+
+func (c *CRL) showRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, c.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.mount = mount
+	if c.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+
+	crl, err := fetchCRL(c.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var issuer pkix.Name
+	issuer.FillFromRDNSequence(&crl.TBSCertList.Issuer)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	fmt.Fprintf(w, "Issuer:\t%s\t\n", formatName(issuer))
+	fmt.Fprintf(w, "This update:\t%s\t\n", crl.TBSCertList.ThisUpdate.Format(time.RFC3339))
+	fmt.Fprintf(w, "Next update:\t%s\t\n", crl.TBSCertList.NextUpdate.Format(time.RFC3339))
+	fmt.Fprintf(w, "Revoked certs:\t%d\t\n", len(crl.TBSCertList.RevokedCertificates))
+	w.Flush()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	fmt.Fprint(w, "\nSERIAL NUMBER\tREVOCATION TIME\t\n")
+	for _, r := range crl.TBSCertList.RevokedCertificates {
+		fmt.Fprintf(w, "%s\t%s\t\n", formatSerial(r.SerialNumber), r.RevocationTime.Format(time.RFC3339))
+	}
+	w.Flush()
+}
+
+func (c *CRL) verifyRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, c.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.mount = mount
+	if c.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Retrieving the CRL:\t")
+	crl, err := fetchCRL(c.mount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	fmt.Fprint(w, "Retrieving the CA cert:\t")
+	caCert, err := readCACert(vaultAPI, c.mount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if caCert == nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, fmt.Errorf("no CA cert found in %s", c.mount))
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	valid := true
+	fmt.Fprint(w, "CRL signed by the CA:\t")
+	if err = caCert.CheckCRLSignature(crl); err != nil {
+		valid = false
+		fmt.Fprintf(w, "NO (%s)\t\n", err)
+	} else {
+		fmt.Fprint(w, "YES\t\n")
+	}
+
+	fmt.Fprint(w, "CRL is current:\t")
+	if crl.HasExpired(time.Now()) {
+		valid = false
+		fmt.Fprintf(w, "NO (next update was %s)\t\n", crl.TBSCertList.NextUpdate.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "YES (next update is %s)\t\n", crl.TBSCertList.NextUpdate.Format(time.RFC3339))
+	}
+
+	if !valid {
+		FatalFlush(w, errors.New("the CRL is not valid"))
+	}
+	w.Flush()
+}
+
+func init() {
+	c := NewCRL()
+	crlCmd.AddCommand(c.Rotate, c.Config, c.Show, c.Verify)
+	RootCmd.AddCommand(crlCmd)
+}
@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/spf13/cobra"
+)
+
+// CSR contains the command for signing certificate signing requests generated
+// outside of Vault.
+type CSR struct {
+	csrPath  string
+	mount    string
+	role     string
+	certPath string
+	ttl      string
+	Sign     *cobra.Command
+}
+
+// NewCSR returns a newly instantiated *CSR.
+func NewCSR() *CSR {
+	c := &CSR{
+		Sign: &cobra.Command{
+			Use:   "csr",
+			Short: "Signs a CSR with a role.",
+			Long: `Signs the PEM-encoded CSR at --csr-path with the role at --role in the
+PKI backend at --mount, so that the private key never leaves the host that
+generated it. The common name and subject alternative names in the CSR are
+checked against the role before the CSR is submitted. The signed cert is
+written to --cert-path followed by the issuing CA.`,
+		},
+	}
+
+	c.Sign.Run = c.signRun
+
+	c.Sign.PersistentFlags().StringVar(
+		&c.csrPath,
+		"csr-path",
+		"",
+		"The file path for the PEM-encoded CSR.",
+	)
+	c.Sign.PersistentFlags().StringVar(
+		&c.mount,
+		"mount",
+		defaultIntMount,
+		"The path in Vault to the intermediate CA backend. Defaults to the mount that 'rotate intermediate-ca' switched to on this host, if any.",
+	)
+	c.Sign.PersistentFlags().StringVar(
+		&c.role,
+		"role",
+		"",
+		"The role to sign the CSR with.",
+	)
+	c.Sign.PersistentFlags().StringVar(
+		&c.certPath,
+		"cert-path",
+		"",
+		"The file path for the signed cert. Should be writable.",
+	)
+	c.Sign.PersistentFlags().StringVar(
+		&c.ttl,
+		"ttl",
+		defaultLeafTTL,
+		"The TTL of the signed cert. Must not exceed the role's max TTL or the intermediate CA's remaining lifetime.",
+	)
+
+	return c
+}
+
+// parseCSRPEM decodes and verifies the signature of a PEM-encoded CSR.
+func parseCSRPEM(contents string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(contents))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("expected a CERTIFICATE REQUEST PEM block, found %s", block.Type)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+// csrNames returns the names and IP SANs requested in the CSR. The common name
+// is the first name.
+func csrNames(csr *x509.CertificateRequest) ([]string, []string) {
+	names := []string{csr.Subject.CommonName}
+	for _, n := range csr.DNSNames {
+		if n != csr.Subject.CommonName {
+			names = append(names, n)
+		}
+	}
+	var ips []string
+	for _, ip := range csr.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	return names, ips
+}
+
+// newCertRequest returns a CSR for the names and IP SANs signed with the key.
+func newCertRequest(key crypto.Signer, commonName string, altNames, ipSANs []string) (*x509.CertificateRequest, error) {
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: altNames,
+	}
+	for _, s := range ipSANs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%s is not a valid IP address", s)
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificateRequest(der)
+}
+
+// signCertRequest submits the CSR to <mount>/sign/<role>. The names from the
+// CSR are passed along explicitly so that roles that don't use the CSR's names
+// produce the same cert.
+func signCertRequest(mount, role string, csr *x509.CertificateRequest, ttl string) (*vault.Secret, error) {
+	names, ips := csrNames(csr)
+	excludeCN := true
+	for _, n := range csr.DNSNames {
+		excludeCN = excludeCN && n != csr.Subject.CommonName
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	return vaultAPI.Write(vaultAPI.Client(), fmt.Sprintf("%s/sign/%s", mount, role), map[string]interface{}{
+		"csr":                  string(csrPEM),
+		"common_name":          csr.Subject.CommonName,
+		"alt_names":            strings.Join(names[1:], ","),
+		"ip_sans":              strings.Join(ips, ","),
+		"ttl":                  ttl,
+		"format":               "pem",
+		"exclude_cn_from_sans": excludeCN,
+	})
+}
+
+func (c *CSR) signRun(cmd *cobra.Command, args []string) {
+	var err error
+	if c.csrPath == "" {
+		log.Fatal("--csr-path must be set.")
+	}
+	if c.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+	if c.role == "" {
+		log.Fatal("--role must be set.")
+	}
+	if c.certPath == "" {
+		log.Fatal("--cert-path must be set.")
+	}
+	var mountSource string
+	if c.mount, mountSource, err = tlsMount(cmd, c.mount); err != nil {
+		log.Fatal(err)
+	}
+	ttl, err := parseTTL(c.ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	fmt.Fprintf(w, "Mount:\t%s (%s)\t\n", c.mount, mountSource)
+
+	fmt.Fprint(w, "Reading the CSR:\t")
+	contents, err := ioutil.ReadFile(c.csrPath)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	csr, err := parseCSRPEM(string(contents))
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if csr.Subject.CommonName == "" {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, errors.New("the CSR does not have a common name"))
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	names, ips := csrNames(csr)
+	fmt.Fprintf(w, "CSR common name:\t%s\t\n", csr.Subject.CommonName)
+	var sans []string
+	sans = append(sans, names[1:]...)
+	sans = append(sans, ips...)
+	fmt.Fprintf(w, "CSR subject alternative names:\t%s\t\n", strings.Join(sans, ", "))
+
+	fmt.Fprint(w, "Checking the request against the role:\t")
+	roleSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", c.mount, c.role))
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if roleSecret == nil || roleSecret.Data == nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, fmt.Errorf("role %s was not found", c.role))
+	}
+	if err = checkNamesAllowed(roleSecret.Data, names, ips); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	roleMaxTTL, err := dataDuration(roleSecret.Data["max_ttl"])
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if roleMaxTTL > 0 {
+		if err = checkTTL("--ttl", ttl, "the role's max TTL", roleMaxTTL); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	fmt.Fprint(w, "Checking the TTL against the intermediate CA:\t")
+	caCert, err := readCACert(vaultAPI, c.mount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if caCert == nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, fmt.Errorf("no CA cert found in %s", c.mount))
+	}
+	if err = checkTTL("--ttl", ttl, "the intermediate CA's remaining lifetime", time.Until(caCert.NotAfter)); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	fmt.Fprint(w, "Signing the CSR with the role:\t")
+	certSecret, err := signCertRequest(c.mount, c.role, csr, c.ttl)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if err = checkIssuedCert(certSecret); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	fmt.Fprint(w, "Writing cert to file:\t")
+	if err = writeFilesAtomic(&outputFile{path: c.certPath, contents: certChainPEM(certSecret), perm: 0644}); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	fmt.Fprint(w, "TLS cert serial number (SAVE THIS):\t")
+	fmt.Fprintf(w, "%s\t\n", certSecret.Data["serial_number"])
+
+	w.Flush()
+}
+
+func init() {
+	c := NewCSR()
+	signCmd.AddCommand(c.Sign)
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// localDefaults contains settings that de-vault records for itself so that
+// later runs can pick them up, e.g. the intermediate CA mount that 'rotate
+// intermediate-ca' switched 'generate tls' over to.
+type localDefaults struct {
+	TLSMount    string   `yaml:"tls-mount,omitempty"`
+	RotatedFrom []string `yaml:"rotated-from,omitempty"`
+}
+
+// localDefaultsPath returns the path to the file containing the local defaults.
+func localDefaultsPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".de-vault", "defaults.yaml")
+}
+
+// readLocalDefaults reads the local defaults. A missing file results in an
+// empty *localDefaults rather than an error.
+func readLocalDefaults() (*localDefaults, error) {
+	d := &localDefaults{}
+	contents, err := ioutil.ReadFile(localDefaultsPath())
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(contents, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// writeLocalDefaults writes out the local defaults, creating the parent
+// directory if necessary.
+func writeLocalDefaults(d *localDefaults) error {
+	p := localDefaultsPath()
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	contents, err := yaml.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return writeFilesAtomic(&outputFile{path: p, contents: contents, perm: 0600})
+}
+
+// rotatedFrom returns the mounts with the old mount added and the new mount
+// removed, so that the list only holds mounts that have been switched away from.
+func rotatedFrom(mounts []string, oldMount, newMount string) []string {
+	retval := []string{oldMount}
+	for _, m := range mounts {
+		if m != oldMount && m != newMount {
+			retval = append(retval, m)
+		}
+	}
+	return retval
+}
+
+// switchTLSMount records that TLS cert commands should use mount from now on
+// instead of oldMount, and returns a description of where it was recorded.
+// With an active context, the context's mount is changed, since the local
+// defaults are shared by every deployment.
+func switchTLSMount(oldMount, mount string) (string, error) {
+	if currentContext == nil {
+		d, err := readLocalDefaults()
+		if err != nil {
+			return "", err
+		}
+		d.TLSMount = mount
+		d.RotatedFrom = rotatedFrom(d.RotatedFrom, oldMount, mount)
+		return localDefaultsPath(), writeLocalDefaults(d)
+	}
+	c, err := readContextConfig()
+	if err != nil {
+		return "", err
+	}
+	ctx := c.lookup(currentContext.Name)
+	if ctx == nil {
+		return "", fmt.Errorf("context %s does not exist", currentContext.Name)
+	}
+	ctx.Mount = mount
+	ctx.RotatedFrom = rotatedFrom(ctx.RotatedFrom, oldMount, mount)
+	return fmt.Sprintf("context %s in %s", ctx.Name, contextConfigPath()), writeContextConfig(c)
+}
+
+// tlsMount returns the intermediate CA mount that the commands using an
+// intermediate CA should default to, along with where it came from so that it
+// can be shown to the user. The --mount flag wins if it was set. Otherwise the
+// mount recorded by 'rotate intermediate-ca' is used, which is the active
+// context's mount if there is a context and the one in the local defaults if
+// there isn't, followed by the default value of --mount. The mount recorded in
+// the local defaults only applies to the user that ran 'rotate intermediate-ca'
+// on this host.
+func tlsMount(cmd *cobra.Command, flagValue string) (string, string, error) {
+	if cmd.Flags().Changed("mount") {
+		return flagValue, "--mount", nil
+	}
+	if currentContext != nil {
+		if currentContext.Mount == "" {
+			return flagValue, "default", nil
+		}
+		return currentContext.Mount, fmt.Sprintf("context %s", currentContext.Name), nil
+	}
+	d, err := readLocalDefaults()
+	if err != nil {
+		return "", "", err
+	}
+	if d.TLSMount == "" {
+		return flagValue, "default", nil
+	}
+	return d.TLSMount, fmt.Sprintf("switched by 'rotate intermediate-ca' in %s", localDefaultsPath()), nil
+}
+
+// switchedTLSMount returns the mount that 'rotate intermediate-ca' last
+// switched the TLS cert commands to, along with the mounts that it switched
+// away from, newest first. The active context's are used if there is a context
+// and the ones in the local defaults if there isn't.
+func switchedTLSMount() (string, []string, error) {
+	if currentContext != nil {
+		return currentContext.Mount, currentContext.RotatedFrom, nil
+	}
+	d, err := readLocalDefaults()
+	if err != nil {
+		return "", nil, err
+	}
+	return d.TLSMount, d.RotatedFrom, nil
+}
+
+// retiringMounts returns the intermediate CA mounts that 'rotate
+// intermediate-ca' switched away from in favor of mount, newest first. Returns
+// nothing if mount isn't the one that it last switched to.
+func retiringMounts(mount string) ([]string, error) {
+	current, previous, err := switchedTLSMount()
+	if err != nil || current != mount {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// reissueMount returns the mount that a cert issued by certMount should be
+// reissued from. Certs issued by an intermediate CA that 'rotate
+// intermediate-ca' switched away from are reissued from the mount returned by
+// tlsMount, while certs issued by any other mount stay with it. The mount
+// returned by tlsMount is also used if --mount was set or certMount is unknown.
+func reissueMount(cmd *cobra.Command, flagValue, certMount string) (string, error) {
+	mount, _, err := tlsMount(cmd, flagValue)
+	if err != nil || cmd.Flags().Changed("mount") || certMount == "" {
+		return mount, err
+	}
+	_, previous, err := switchedTLSMount()
+	if err != nil {
+		return "", err
+	}
+	if containsString(previous, certMount) {
+		return mount, nil
+	}
+	return certMount, nil
+}
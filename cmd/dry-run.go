@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// pendingChangesExitCode is the exit code used by --dry-run and 'plan' when
+// changes are pending, and by 'check all' when drift is found. Errors exit with
+// 1 and no pending changes with 0.
+const pendingChangesExitCode = 2
+
+// dryRunAnnotation marks the commands that support --dry-run. Commands that
+// need the responses to their writes, such as issued certs, can't be run
+// without touching Vault.
+const dryRunAnnotation = "de-vault.cyverse.org/dry-run"
+
+// plannedValue stands in for values that are only known once a change has
+// been made, e.g. the CSR generated by an intermediate CA backend.
+const plannedValue = "(known after apply)"
+
+// The kinds of planned changes.
+const (
+	changeMount   = "mount"
+	changeUnmount = "unmount"
+	changeWrite   = "write"
+	changeDelete  = "delete"
+	changeFile    = "file"
+)
+
+// plannedChange is a change to Vault or the local filesystem recorded during
+// a dry run.
+type plannedChange struct {
+	kind    string
+	path    string
+	detail  string
+	data    map[string]interface{}
+	current map[string]interface{}
+}
+
+// recorder is a vaultClient that passes reads through to Vault but records
+// the changes that would be made instead of making them. Reads from backends
+// that are planned to be mounted or unmounted return nothing, the same as
+// they would once the changes were made.
+type recorder struct {
+	vaultClient
+	changes []*plannedChange
+	mounts  map[string]bool
+}
+
+// newRecorder returns a *recorder that reads from the client.
+func newRecorder(client vaultClient) *recorder {
+	return &recorder{
+		vaultClient: client,
+		mounts:      map[string]bool{},
+	}
+}
+
+// plannedMount returns true if the backend at the path is planned to be
+// mounted during the current dry run.
+func plannedMount(path string) bool {
+	rec, ok := vaultAPI.(*recorder)
+	return ok && rec.mounts[strings.Trim(path, "/")]
+}
+
+// Mount records the mount instead of mounting the backend.
+func (r *recorder) Mount(path string, m *vault.MountInput) error {
+	path = strings.Trim(path, "/")
+	r.mounts[path] = true
+	detail := fmt.Sprintf("type %s", m.Type)
+	if m.Config.MaxLeaseTTL != "" {
+		detail += fmt.Sprintf(", max lease TTL %s", m.Config.MaxLeaseTTL)
+	}
+	r.changes = append(r.changes, &plannedChange{kind: changeMount, path: path, detail: detail})
+	return nil
+}
+
+// Unmount records the unmount instead of unmounting the backend.
+func (r *recorder) Unmount(path string) error {
+	path = strings.Trim(path, "/")
+	r.mounts[path] = false
+	r.changes = append(r.changes, &plannedChange{kind: changeUnmount, path: path})
+	return nil
+}
+
+// ListMounts lists the mounted backends as they would be after the recorded
+// changes.
+func (r *recorder) ListMounts() (map[string]*vault.MountOutput, error) {
+	mounts, err := r.vaultClient.ListMounts()
+	if err != nil {
+		return nil, err
+	}
+	listed := map[string]*vault.MountOutput{}
+	for path, m := range mounts {
+		if mounted, ok := r.mounts[strings.Trim(path, "/")]; !ok || mounted {
+			listed[path] = m
+		}
+	}
+	for path, mounted := range r.mounts {
+		if _, ok := listed[path+"/"]; mounted && !ok {
+			listed[path+"/"] = &vault.MountOutput{Type: "pki"}
+		}
+	}
+	return listed, nil
+}
+
+// touchesPlannedMount returns true if the path is in a backend that is planned
+// to be mounted or unmounted.
+func (r *recorder) touchesPlannedMount(path string) bool {
+	for m := range r.mounts {
+		if path == m || strings.HasPrefix(path, m+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Read reads the path from Vault unless it's in a backend that is planned to
+// be mounted or unmounted.
+func (r *recorder) Read(c *vault.Client, path string) (*vault.Secret, error) {
+	if r.touchesPlannedMount(path) {
+		return nil, nil
+	}
+	return r.vaultClient.Read(c, path)
+}
+
+// Write records the write along with the data currently at the path, if it
+// can be read, and returns placeholders for the values that callers use from
+// the responses to writes.
+func (r *recorder) Write(c *vault.Client, path string, data map[string]interface{}) (*vault.Secret, error) {
+	change := &plannedChange{kind: changeWrite, path: path, data: data}
+	if current, err := r.Read(c, path); err == nil && current != nil {
+		change.current = current.Data
+	}
+	r.changes = append(r.changes, change)
+	return &vault.Secret{
+		Data: map[string]interface{}{
+			"csr":         plannedValue,
+			"certificate": plannedValue,
+		},
+	}, nil
+}
+
+// Delete records the deletion instead of deleting the path.
+func (r *recorder) Delete(c *vault.Client, path string) (*vault.Secret, error) {
+	r.changes = append(r.changes, &plannedChange{kind: changeDelete, path: path})
+	return nil, nil
+}
+
+// recordFiles records the files instead of writing them.
+func (r *recorder) recordFiles(files ...*outputFile) {
+	for _, f := range files {
+		r.changes = append(r.changes, &plannedChange{
+			kind:   changeFile,
+			path:   f.path,
+			detail: fmt.Sprintf("%d bytes, mode %s", len(f.contents), f.perm),
+		})
+	}
+}
+
+// formatPlanValue formats a value written to or read from Vault for display
+// in a plan. Multi-line values such as PEM blocks are summarized.
+func formatPlanValue(v interface{}) string {
+	var s string
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case []string, []interface{}:
+		s = strings.Join(dataStrings(t), ",")
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+	if lines := strings.Count(strings.TrimSpace(s), "\n"); lines > 0 {
+		return fmt.Sprintf("(%d lines)", lines+1)
+	}
+	return s
+}
+
+// planValuesEqual returns true if the value that would be written matches the
+// current one. TTLs are compared as durations since Vault returns them in
+// seconds.
+func planValuesEqual(key string, current, desired interface{}) bool {
+	if formatPlanValue(current) == formatPlanValue(desired) {
+		return true
+	}
+	if !strings.HasSuffix(key, "ttl") {
+		return false
+	}
+	c, err := dataDuration(current)
+	if err != nil {
+		return false
+	}
+	d, err := dataDuration(desired)
+	return err == nil && c == d
+}
+
+// printPlan writes the recorded changes as a diff: additions are prefixed
+// with +, removals with -, and changes to existing data with ~.
+func (r *recorder) printPlan(out io.Writer) {
+	if len(r.changes) == 0 {
+		fmt.Fprintln(out, "\nNo changes pending.")
+		return
+	}
+	fmt.Fprintln(out, "\nPlanned changes:")
+	for _, c := range r.changes {
+		switch c.kind {
+		case changeMount, changeFile:
+			fmt.Fprintf(out, "+ %s %s (%s)\n", c.kind, c.path, c.detail)
+		case changeUnmount, changeDelete:
+			fmt.Fprintf(out, "- %s %s\n", c.kind, c.path)
+		case changeWrite:
+			var keys []string
+			for k := range c.data {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if c.current == nil {
+				fmt.Fprintf(out, "+ %s %s\n", c.kind, c.path)
+				for _, k := range keys {
+					fmt.Fprintf(out, "    + %s: %s\n", k, formatPlanValue(c.data[k]))
+				}
+				continue
+			}
+			fmt.Fprintf(out, "~ %s %s\n", c.kind, c.path)
+			for _, k := range keys {
+				current, ok := c.current[k]
+				if ok && planValuesEqual(k, current, c.data[k]) {
+					continue
+				}
+				if ok {
+					fmt.Fprintf(out, "    - %s: %s\n", k, formatPlanValue(current))
+				}
+				fmt.Fprintf(out, "    + %s: %s\n", k, formatPlanValue(c.data[k]))
+			}
+		}
+	}
+	if len(r.changes) == 1 {
+		fmt.Fprintln(out, "\n1 change pending.")
+	} else {
+		fmt.Fprintf(out, "\n%d changes pending.\n", len(r.changes))
+	}
+}
@@ -0,0 +1,13 @@
+package cmd
+
+import "github.com/spf13/cobra"
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports the Vault resources represented by the subcommands to files.",
+	Long:  `Exports the Vault resources represented by the subcommands to files.`,
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+}
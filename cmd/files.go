@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// outputFile is the contents of a file that should be written to disk.
+type outputFile struct {
+	path     string
+	contents []byte
+	perm     os.FileMode
+}
+
+// stageFile writes the contents of f to a temporary file in the same
+// directory as f.path and returns the name of the temporary file.
+func stageFile(f *outputFile) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path)+".")
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+	if _, err = tmp.Write(f.contents); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	if err = os.Chmod(tmpName, f.perm); err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	return tmpName, nil
+}
+
+// writeFilesAtomic stages all of the files in temporary locations before
+// renaming them into place, so readers never see a partially written file. The
+// existing files are moved aside first, and if any of the renames fail the
+// files that were already replaced are restored, so a failure leaves the
+// existing files untouched rather than mixing old and new ones, e.g. a new key
+// next to an old cert. During a dry run the files are recorded instead of
+// written.
+func writeFilesAtomic(files ...*outputFile) error {
+	if rec, ok := vaultAPI.(*recorder); ok {
+		rec.recordFiles(files...)
+		return nil
+	}
+	var staged []string
+	cleanup := func() {
+		for _, s := range staged {
+			os.Remove(s)
+		}
+	}
+	for _, f := range files {
+		tmpName, err := stageFile(f)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		staged = append(staged, tmpName)
+	}
+
+	// backups holds the paths that the existing files were moved to, or an
+	// empty string if there was no existing file.
+	var backups []string
+	rollback := func() {
+		for idx := len(backups) - 1; idx >= 0; idx-- {
+			if backups[idx] == "" {
+				os.Remove(files[idx].path)
+			} else {
+				os.Rename(backups[idx], files[idx].path)
+			}
+		}
+		cleanup()
+	}
+	for idx, f := range files {
+		backup := staged[idx] + ".old"
+		if err := os.Rename(f.path, backup); os.IsNotExist(err) {
+			backup = ""
+		} else if err != nil {
+			rollback()
+			return err
+		}
+		if err := os.Rename(staged[idx], f.path); err != nil {
+			if backup != "" {
+				os.Rename(backup, f.path)
+			}
+			rollback()
+			return err
+		}
+		backups = append(backups, backup)
+	}
+	for _, b := range backups {
+		if b != "" {
+			os.Remove(b)
+		}
+	}
+	return nil
+}
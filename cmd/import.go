@@ -0,0 +1,13 @@
+package cmd
+
+import "github.com/spf13/cobra"
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Imports externally created resources into the Vault resources represented by the subcommands.",
+	Long:  `Imports externally created resources into the Vault resources represented by the subcommands.`,
+}
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+}
@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"text/tabwriter"
+	"time"
 
 	"github.com/cyverse-de/vaulter"
 	"github.com/spf13/cobra"
@@ -15,23 +19,46 @@ import (
 // IntermediateCA contains the functionality associated with checking,
 // initializing, and removing intermediate CAs.
 type IntermediateCA struct {
-	rootMount  string
-	mount      string
-	role       string
-	commonName string
-	Init       *cobra.Command
-	Check      *cobra.Command
-	Remove     *cobra.Command
+	rootMount   string
+	mount       string
+	role        string
+	commonName  string
+	keys        keySettings
+	mountMaxTTL string
+	ttl         string
+	newMount    string
+	chainOut    string
+	csrOut      string
+	certFile    string
+	chainFile   string
+	maxCerts    int
+	baseURL     string
+	urlsOnly    bool
+	Init        *cobra.Command
+	Check       *cobra.Command
+	Remove      *cobra.Command
+	Rotate      *cobra.Command
+	Import      *cobra.Command
 }
 
 // NewIntermediateCA returns a newly initialized *IntermediateCA.
 func NewIntermediateCA() *IntermediateCA {
 	ca := &IntermediateCA{
 		Init: &cobra.Command{
-			Use:   "intermediate-ca",
-			Short: "Initialize an intermediate CA in Vault.",
+			Use:         "intermediate-ca",
+			Short:       "Initialize an intermediate CA in Vault.",
+			Annotations: map[string]string{dryRunAnnotation: "true"},
 			Long: `Initializes an intermediate CA in Vault, the end result being a
-new PKI backend that has a role configured and a signed CSR imported into it.`,
+new PKI backend that has a role configured and a signed CSR imported into it.
+
+If the root CA is kept offline, use --csr-out to stop after the CSR has been
+generated and written to a file. Once the CSR has been signed, use 'import
+intermediate-ca' to finish setting up the intermediate CA. Running this command
+again with --csr-out while the CSR is pending will not generate a new CSR as
+long as the file still exists.
+
+With --urls-only, only the CA and CRL URLs of the existing intermediate CA at
+--mount are configured, based on --base-url.`,
 		},
 		Check: &cobra.Command{
 			Use:   "intermediate-ca",
@@ -40,22 +67,64 @@ new PKI backend that has a role configured and a signed CSR imported into it.`,
 the following:
 	1. If the intermediate CA backend is mounted.
 	2. If the role exists.
-	3. If the intermediate CA backend is configured correctly.
+	3. If the intermediate CA cert was imported.
+	4. When the intermediate CA cert and the root CA cert expire.
+	5. If the intermediate CA cert was signed by the root CA at --root-mount,
+	   or by the root of the chain imported with it.
+	6. If the intermediate CA cert outlives the root CA cert.
+	7. If the intermediate CA backend is configured correctly.
 This command does not create any of the above if it does not exist. If the
 backend is not mounted, then the status of each subsequent check will be
 'UNKNOWN'.`,
 		},
 		Remove: &cobra.Command{
-			Use:   "intermediate-ca",
-			Short: "Removes the intermediate CA from Vault.",
+			Use:         "intermediate-ca",
+			Short:       "Removes the intermediate CA from Vault.",
+			Annotations: map[string]string{dryRunAnnotation: "true", destructiveAnnotation: "true"},
 			Long: `Removes the intermediate CA from Vault. This is accomplished by
 unmounted the PKI backend handling operations for the intermediate CA.`,
 		},
+		Rotate: &cobra.Command{
+			Use:         "intermediate-ca",
+			Short:       "Replaces the intermediate CA in Vault without downtime.",
+			Annotations: map[string]string{destructiveAnnotation: "true"},
+			Long: `Replaces the intermediate CA in Vault by setting up a new intermediate CA
+on the backend at --new-mount, signed by the root CA at --root-mount. The roles
+from the current intermediate CA are copied to the new backend and the commands
+that use an intermediate CA are switched over to it. Certs issued by the current
+intermediate CA remain valid, and --chain-out can be used to write out a bundle
+containing both intermediate CA certs and the root CA cert. Until the current
+intermediate CA is removed or expires, 'generate tls' and 'renew tls' also add
+its cert to the CA certs that they write, the ca.crt of secrets and the
+truststore, so that clients given new certs keep trusting the certs it issued.
+The current intermediate CA is left in place; remove it with 'remove
+intermediate-ca' once the reported retirement time has passed.
+
+The switch is only recorded locally, in ~/.de-vault/defaults.yaml or in the
+active context, so it only applies to the user that ran this command on this
+host. Elsewhere, pass --mount to the commands that use an intermediate CA until
+the old intermediate CA is removed. Likewise, the --chain-out bundle is only written to
+a local file and has to be distributed separately. The TLS commands print the
+mount that they use.`,
+		},
+		Import: &cobra.Command{
+			Use:         "intermediate-ca",
+			Short:       "Imports an externally signed intermediate CA cert into Vault.",
+			Annotations: map[string]string{dryRunAnnotation: "true"},
+			Long: `Imports an intermediate CA cert signed by an external or offline
+root CA into the backend at --mount, completing the setup started by 'init
+intermediate-ca --csr-out'. The cert is verified against the chain in --chain
+if it is provided, and the chain is imported along with the cert. The CA and CRL
+URLs are configured afterwards. Running this command again after the cert has
+been imported only reconfigures the URLs.`,
+		},
 	}
 
 	ca.Init.Run = ca.initRun
 	ca.Check.Run = ca.checkRun
 	ca.Remove.Run = ca.removeRun
+	ca.Rotate.Run = ca.rotateRun
+	ca.Import.Run = ca.importRun
 
 	ca.Init.PersistentFlags().StringVar(
 		&ca.mount, // defined in root.go
@@ -81,6 +150,31 @@ unmounted the PKI backend handling operations for the intermediate CA.`,
 		"",
 		"The common name to use for operations on the intermediate CA.",
 	)
+	ca.keys.addFlags(ca.Init.PersistentFlags())
+	ca.Init.PersistentFlags().StringVar(
+		&ca.csrOut,
+		"csr-out",
+		"",
+		"Write the CSR to this file instead of signing it with the root CA at --root-mount.",
+	)
+	ca.Init.PersistentFlags().BoolVar(
+		&ca.urlsOnly,
+		"urls-only",
+		false,
+		"Only configure the CA and CRL URLs of the existing intermediate CA at --mount.",
+	)
+	ca.Init.PersistentFlags().StringVar(
+		&ca.mountMaxTTL,
+		"mount-max-ttl",
+		defaultIntMountMaxTTL,
+		"The max lease TTL for the intermediate CA pki backend.",
+	)
+	ca.Init.PersistentFlags().StringVar(
+		&ca.ttl,
+		"ttl",
+		defaultIntTTL,
+		"The TTL of the signed intermediate CA cert. Must not exceed --mount-max-ttl or the root CA's remaining lifetime.",
+	)
 
 	ca.Check.PersistentFlags().StringVar(
 		&ca.mount, // defined in root.go
@@ -101,6 +195,90 @@ unmounted the PKI backend handling operations for the intermediate CA.`,
 		"The common name to use for operations on the intermediate CA.",
 	)
 
+	ca.Rotate.PersistentFlags().StringVar(
+		&ca.mount,
+		"mount",
+		defaultIntMount,
+		"The path in Vault to the current intermediate CA pki backend.",
+	)
+	ca.Rotate.PersistentFlags().StringVar(
+		&ca.newMount,
+		"new-mount",
+		"",
+		"The path in Vault for the new intermediate CA pki backend.",
+	)
+	ca.Rotate.PersistentFlags().StringVar(
+		&ca.rootMount,
+		"root-mount",
+		defaultRootMount,
+		"The path in Vault to the root CA pki backend.",
+	)
+	ca.Rotate.PersistentFlags().StringVar(
+		&ca.commonName,
+		"common-name",
+		"",
+		"The common name for the new intermediate CA. Defaults to the common name of the current one.",
+	)
+	ca.Rotate.PersistentFlags().StringVar(
+		&ca.chainOut,
+		"chain-out",
+		"",
+		"The file path for a PEM bundle containing both intermediate CA certs and the root CA cert.",
+	)
+	ca.keys.addFlags(ca.Rotate.PersistentFlags())
+	ca.Rotate.PersistentFlags().StringVar(
+		&ca.mountMaxTTL,
+		"mount-max-ttl",
+		defaultIntMountMaxTTL,
+		"The max lease TTL for the new intermediate CA pki backend.",
+	)
+	ca.Rotate.PersistentFlags().StringVar(
+		&ca.ttl,
+		"ttl",
+		defaultIntTTL,
+		"The TTL of the new intermediate CA cert. Must not exceed --mount-max-ttl or the root CA's remaining lifetime.",
+	)
+
+	ca.Import.PersistentFlags().StringVar(
+		&ca.mount,
+		"mount",
+		defaultIntMount,
+		"The path in Vault to the intermediate CA pki backend.",
+	)
+	ca.Import.PersistentFlags().StringVar(
+		&ca.certFile,
+		"cert",
+		"",
+		"The file path for the signed intermediate CA cert.",
+	)
+	for _, c := range []*cobra.Command{ca.Init, ca.Import, ca.Check, ca.Rotate} {
+		c.PersistentFlags().StringVar(
+			&ca.baseURL,
+			"base-url",
+			"",
+			"The URL that clients reach Vault at, used for the CA and CRL URLs. Defaults to --api-url.",
+		)
+	}
+	ca.Import.PersistentFlags().StringVar(
+		&ca.chainFile,
+		"chain",
+		"",
+		"The file path for the chain of CA certs that signed the intermediate CA cert, issuer first.",
+	)
+
+	ca.Check.PersistentFlags().StringVar(
+		&ca.rootMount,
+		"root-mount",
+		defaultRootMount,
+		"The path in Vault to the root CA pki backend. Set to an empty string to use the root CA cert imported along with the intermediate CA cert.",
+	)
+	ca.Check.PersistentFlags().IntVar(
+		&ca.maxCerts,
+		"max-certs",
+		defaultMaxCerts,
+		"Warn if the cert store of the intermediate CA contains more certs than this.",
+	)
+
 	ca.Remove.PersistentFlags().StringVar(
 		&ca.mount, // defined in root.go
 		"mount",
@@ -127,51 +305,265 @@ func (i *IntermediateCA) initRun(cmd *cobra.Command, args []string) {
 	if i.mount == "" {
 		log.Fatal("--mount was not set.")
 	}
+	if i.urlsOnly {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+		i.initURLs(w)
+		w.Flush()
+		return
+	}
 	if i.role == "" {
 		log.Fatal("--role was not set.")
 	}
 	if i.commonName == "" {
 		log.Fatal("--common-name was not set.")
 	}
+	i.checkSettings()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	if i.csrOut != "" {
+		i.initOffline(w)
+		w.Flush()
+		return
+	}
+	i.checkRootLifetime(w)
+	i.setup(w, i.mount)
+	w.Flush()
+}
+
+// initURLs configures the CA and CRL URLs of an intermediate CA that has
+// already been set up, without generating a new key or cert.
+func (i *IntermediateCA) initURLs(w *tabwriter.Writer) {
+	fmt.Fprint(w, "Intermediate CA cert already imported:\t")
+	caCert, err := readCACert(vaultAPI, i.mount)
+	if err != nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+		FatalFlush(w, err)
+	}
+	if caCert == nil {
+		fmt.Fprint(w, "NO\t\n")
+		FatalFlush(w, fmt.Errorf("%s has no CA cert; run 'init intermediate-ca' without --urls-only first", i.mount))
+	}
+	fmt.Fprint(w, "YES\t\n")
+	i.configureURLs(w, i.mount)
+}
+
+// initOffline mounts the intermediate CA backend and writes a CSR out to a
+// file so that it can be signed by an offline root CA. A CSR is not generated
+// if the backend is still waiting on the signed cert for a CSR that was
+// written out previously, since generating a new one would replace the key.
+func (i *IntermediateCA) initOffline(w *tabwriter.Writer) {
+	i.mountBackend(w, i.mount)
+
+	fmt.Fprint(w, "Intermediate CA cert already imported:\t")
+	caCert, err := readCACert(vaultAPI, i.mount)
+	if err != nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+		FatalFlush(w, err)
+	}
+	if caCert != nil {
+		fmt.Fprint(w, "YES\t\n")
+		FatalFlush(w, fmt.Errorf("%s already has a CA cert", i.mount))
+	}
+	fmt.Fprint(w, "NO\t\n")
+
+	fmt.Fprint(w, "CSR pending:\t")
+	if _, err = os.Stat(i.csrOut); err == nil {
+		fmt.Fprint(w, "YES\t\n")
+		fmt.Fprintf(w, "Existing CSR:\t%s\t\n", i.csrOut)
+		return
+	}
+	fmt.Fprint(w, "NO\t\n")
+
+	csr := i.generateCSR(w, i.mount)
+
+	fmt.Fprint(w, "Writing the CSR to file:\t")
+	if err = writeFilesAtomic(&outputFile{path: i.csrOut, contents: []byte(csr + "\n"), perm: 0644}); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+}
+
+func (i *IntermediateCA) importRun(cmd *cobra.Command, args []string) {
+	if i.mount == "" {
+		log.Fatal("--mount was not set.")
+	}
+	if i.certFile == "" {
+		log.Fatal("--cert was not set.")
+	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
 
+	fmt.Fprint(w, "Reading the signed cert:\t")
+	certContents, err := ioutil.ReadFile(i.certFile)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	cert, err := parseCertPEM(string(certContents))
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	bundle := string(encodeCertPEM(cert))
+	if i.chainFile != "" {
+		fmt.Fprint(w, "Verifying the signed cert against the chain:\t")
+		chainContents, err := ioutil.ReadFile(i.chainFile)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		chain, err := parseCertsPEM(string(chainContents))
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if err = cert.CheckSignatureFrom(chain[0]); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if cert.NotAfter.After(chain[0].NotAfter) {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, errors.New("the signed cert expires after its issuer"))
+		}
+		for _, c := range chain {
+			bundle += string(encodeCertPEM(c))
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+
+	fmt.Fprint(w, "Intermediate CA cert already imported:\t")
+	caCert, err := readCACert(vaultAPI, i.mount)
+	if err != nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+		FatalFlush(w, err)
+	}
+	switch {
+	case caCert == nil:
+		fmt.Fprint(w, "NO\t\n")
+		i.importCert(w, i.mount, bundle)
+	case bytes.Equal(caCert.Raw, cert.Raw):
+		fmt.Fprint(w, "YES\t\n")
+	default:
+		fmt.Fprint(w, "UNKNOWN\t\n")
+		FatalFlush(w, fmt.Errorf("%s already has a different CA cert", i.mount))
+	}
+
+	i.configureURLs(w, i.mount)
+	w.Flush()
+}
+
+// checkSettings validates the key and TTL settings, exiting if they are not
+// usable.
+func (i *IntermediateCA) checkSettings() {
+	if err := i.keys.validate(); err != nil {
+		log.Fatal(err)
+	}
+	ttls, err := parseTTLs(map[string]string{
+		"--mount-max-ttl": i.mountMaxTTL,
+		"--ttl":           i.ttl,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = checkTTL("--ttl", ttls["--ttl"], "--mount-max-ttl", ttls["--mount-max-ttl"]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkRootLifetime makes sure that the root CA exists and will outlive an
+// intermediate CA cert signed with the configured TTL.
+func (i *IntermediateCA) checkRootLifetime(w *tabwriter.Writer) {
+	fmt.Fprint(w, "Checking the TTL against the root CA:\t")
+	ttl, err := parseTTL(i.ttl)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	rootCert, err := readCACert(vaultAPI, i.rootMount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if rootCert == nil && plannedMount(i.rootMount) {
+		fmt.Fprint(w, "SKIPPED (the root CA has not been created yet)\t\n")
+		return
+	}
+	if rootCert == nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, fmt.Errorf("no root CA cert found in %s", i.rootMount))
+	}
+	if err = checkTTL("--ttl", ttl, "the root CA's remaining lifetime", time.Until(rootCert.NotAfter)); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+}
+
+// setup mounts a PKI backend at the given path, has the root CA sign a CSR
+// generated by the backend, imports the signed cert, and configures the CA and
+// CRL URLs.
+func (i *IntermediateCA) setup(w *tabwriter.Writer, mount string) {
+	i.mountBackend(w, mount)
+	csr := i.generateCSR(w, mount)
+	cert := i.signCSR(w, csr)
+	i.importCert(w, mount, cert)
+	i.configureURLs(w, mount)
+}
+
+// mountBackend mounts a PKI backend for the intermediate CA at the given path
+// if it isn't mounted already.
+func (i *IntermediateCA) mountBackend(w *tabwriter.Writer, mount string) {
 	fmt.Fprintf(w, "Creating the intermediate CA:\t")
-	hasIntermediate, err := vaulter.IsMounted(vaultAPI, i.mount)
+	hasIntermediate, err := vaulter.IsMounted(vaultAPI, mount)
 	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
 	if !hasIntermediate {
-		if err = vaulter.Mount(vaultAPI, i.mount, &vaulter.MountConfiguration{
+		if err = vaulter.Mount(vaultAPI, mount, &vaulter.MountConfiguration{
 			Type:        "pki",
 			Description: "intermediate CA",
-			MaxLeaseTTL: "26280h",
+			MaxLeaseTTL: i.mountMaxTTL,
 		}); err != nil {
 			fmt.Fprint(w, "FAILURE\t\n")
 			FatalFlush(w, err)
 		}
 	}
 	fmt.Fprint(w, "SUCCESS\t\n")
+}
 
+// generateCSR has the backend at the given path generate a key and returns a
+// CSR for it.
+func (i *IntermediateCA) generateCSR(w *tabwriter.Writer, mount string) string {
 	fmt.Fprintf(w, "Creating a CSR:\t")
 	csrConfig := &vaulter.CSRConfig{
 		CommonName: i.commonName,
-		TTL:        "26280h",
-		KeyBits:    4096,
+		TTL:        i.ttl,
+		KeyBits:    i.keys.keyBits,
 	}
-	csrSecret, err := vaulter.CSR(vaultAPI, i.mount, csrConfig)
+	csrSecret, err := intermediateCSR(vaultAPI, mount, csrConfig, i.keys.keyType)
 	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
+	csr, ok := csrSecret.Data["csr"].(string)
+	if !ok {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, errors.New("no CSR found"))
+	}
 	fmt.Fprint(w, "SUCCESS\t\n")
+	return csr
+}
 
+// signCSR has the root CA sign the CSR and returns the signed cert.
+func (i *IntermediateCA) signCSR(w *tabwriter.Writer, csr string) string {
 	fmt.Fprint(w, "Signing the intermediate CSR with the root CA:\t")
-	csr := csrSecret.Data["csr"].(string)
 	csrSigningConfig := &vaulter.CSRSigningConfig{
 		CommonName: i.commonName,
-		TTL:        "8760h",
+		TTL:        i.ttl,
 	}
 	signedCert, err := vaulter.SignCSR(vaultAPI, i.rootMount, csr, csrSigningConfig)
 	if err != nil {
@@ -179,18 +571,61 @@ func (i *IntermediateCA) initRun(cmd *cobra.Command, args []string) {
 		FatalFlush(w, err)
 	}
 	fmt.Fprint(w, "SUCCESS\t\n")
+	return signedCert.Data["certificate"].(string)
+}
 
+// importCert imports the signed cert into the backend at the given path.
+func (i *IntermediateCA) importCert(w *tabwriter.Writer, mount, certContents string) {
 	fmt.Fprint(w, "Importing the signed cert into the intermediate CA:\t")
-	certContents := signedCert.Data["certificate"].(string)
-	_, err = vaulter.ImportCert(vaultAPI, i.mount, certContents)
+	_, err := vaulter.ImportCert(vaultAPI, mount, certContents)
 	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
 	fmt.Fprint(w, "SUCCESS\t\n")
+}
 
+// urlBase returns the URL that the CA and CRL URLs are based on.
+func (i *IntermediateCA) urlBase() (*url.URL, error) {
+	if i.baseURL != "" {
+		return url.Parse(i.baseURL)
+	}
+	return url.Parse(vaultURL)
+}
+
+// caURLs returns the CA and CRL URLs for the backend at the given path, in the
+// same form that they're configured in.
+func (i *IntermediateCA) caURLs(mount string) (string, string, error) {
+	urlParts, err := i.urlBase()
+	if err != nil {
+		return "", "", err
+	}
+	base := fmt.Sprintf("%s://%s:%s/v1/%s", urlParts.Scheme, urlParts.Hostname(), urlParts.Port(), mount)
+	return base + "/ca", base + "/crl", nil
+}
+
+// urlsConfigured returns true if the CA and CRL URLs for the backend at the
+// given path include the expected ones.
+func (i *IntermediateCA) urlsConfigured(mount string) (bool, error) {
+	caURL, crlURL, err := i.caURLs(mount)
+	if err != nil {
+		return false, err
+	}
+	configSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/config/urls", mount))
+	if err != nil {
+		return false, err
+	}
+	if configSecret == nil || configSecret.Data == nil {
+		return false, nil
+	}
+	return containsString(dataStrings(configSecret.Data["issuing_certificates"]), caURL) &&
+		containsString(dataStrings(configSecret.Data["crl_distribution_points"]), crlURL), nil
+}
+
+// configureURLs sets the CA and CRL URLs for the backend at the given path.
+func (i *IntermediateCA) configureURLs(w *tabwriter.Writer, mount string) {
 	fmt.Fprint(w, "Set the CA and CRL URLs for the intermediate CA:\t")
-	urlParts, err := url.Parse(vaultURL)
+	urlParts, err := i.urlBase()
 	if err != nil {
 		FatalFlush(w, err)
 	}
@@ -198,17 +633,21 @@ func (i *IntermediateCA) initRun(cmd *cobra.Command, args []string) {
 		vaultAPI,
 		urlParts.Scheme,
 		fmt.Sprintf("%s:%s", urlParts.Hostname(), urlParts.Port()),
-		i.mount,
+		mount,
 	)
 	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
 	fmt.Fprint(w, "SUCCESS\t\n")
-	w.Flush()
 }
 
 func (i *IntermediateCA) checkRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, i.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	i.mount = mount
 	if i.mount == "" {
 		log.Fatal("--mount was not set.")
 	}
@@ -247,53 +686,127 @@ func (i *IntermediateCA) checkRun(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	fmt.Fprint(w, "Intermediate CA backend is configured correctly:\t")
+	// A mounted backend without a CA cert is either waiting on a signed cert
+	// for the CSR generated by 'init intermediate-ca --csr-out', or was left
+	// behind by an 'init intermediate-ca' that failed midway.
+	fmt.Fprint(w, "Intermediate CA cert:\t")
+	var caCert *x509.Certificate
 	if !hasIntermediate {
 		fmt.Fprint(w, "UNKNOWN\t\n")
 	} else {
-		configSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/config/urls", i.mount))
+		caCert, err = readCACert(vaultAPI, i.mount)
 		if err != nil {
 			FatalFlush(w, err)
 		}
-		if configSecret == nil {
-			FatalFlush(w, errors.New("config was nil"))
+		if caCert == nil {
+			fmt.Fprint(w, "NOT IMPORTED (CSR pending or 'init intermediate-ca' failed midway)\t\n")
+		} else {
+			fmt.Fprint(w, "IMPORTED\t\n")
 		}
-		if configSecret.Data == nil {
-			FatalFlush(w, errors.New("config.Data was nil"))
+	}
+
+	fmt.Fprint(w, "Intermediate CA key:\t")
+	if caCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		fmt.Fprintf(w, "%s\t\n", certKeySettings(caCert))
+	}
+
+	fmt.Fprint(w, "Intermediate CA cert expires:\t")
+	if caCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		fmt.Fprintf(w, "%s (%d days remaining)\t\n", caCert.NotAfter.Format(time.RFC3339), daysRemaining(caCert))
+	}
+
+	var (
+		rootCert *x509.Certificate
+		chain    []*x509.Certificate
+	)
+	if caCert != nil {
+		if chain, err = readImportedChain(i.mount); err != nil {
+			FatalFlush(w, err)
 		}
-		var (
-			ok            bool
-			issuingCerts  []interface{}
-			crlDistPoints []interface{}
-			config        map[string]interface{}
-		)
-		config = configSecret.Data
-		if issuingCerts, ok = config["issuing_certificates"].([]interface{}); !ok {
-			FatalFlush(w, errors.New("issuing_certificates was not found"))
+		if i.rootMount != "" {
+			if rootCert, err = readCACert(vaultAPI, i.rootMount); err != nil {
+				FatalFlush(w, err)
+			}
 		}
-		expected := fmt.Sprintf("%s/v1/%s/ca", vaultURL, i.mount)
-		found := false
-		for _, c := range issuingCerts {
-			found = found || c.(string) == expected
+		// Without a root CA in Vault, the root is the last cert in the chain
+		// that was imported along with the intermediate CA cert.
+		if rootCert == nil && len(chain) > 0 && chain[len(chain)-1].CheckSignatureFrom(chain[len(chain)-1]) == nil {
+			rootCert = chain[len(chain)-1]
 		}
-		if !found {
-			fmt.Fprint(w, "NO\t\n")
-			FatalFlush(w, errors.New("issuing_certificates was %s"))
+	}
+
+	fmt.Fprint(w, "Root CA cert expires:\t")
+	if rootCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		fmt.Fprintf(w, "%s (%d days remaining)\t\n", rootCert.NotAfter.Format(time.RFC3339), daysRemaining(rootCert))
+	}
+
+	fmt.Fprint(w, "Intermediate CA cert signed by the root CA:\t")
+	if caCert == nil || rootCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else if err = verifyAgainst(caCert, []*x509.Certificate{rootCert}, chain...); err != nil {
+		fmt.Fprintf(w, "NO (%s)\t\n", err)
+	} else {
+		fmt.Fprint(w, "YES\t\n")
+	}
+
+	fmt.Fprint(w, "Intermediate CA cert outlives the root CA cert:\t")
+	if caCert == nil || rootCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else if caCert.NotAfter.After(rootCert.NotAfter) {
+		fmt.Fprintf(w, "YES (WARNING: certs stop verifying after %s)\t\n", rootCert.NotAfter.Format(time.RFC3339))
+	} else {
+		fmt.Fprint(w, "NO\t\n")
+	}
+
+	fmt.Fprint(w, "Intermediate CA backend is configured correctly:\t")
+	if caCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		configSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/config/urls", i.mount))
+		if err != nil {
+			fmt.Fprint(w, "UNKNOWN\t\n")
+			FatalFlush(w, err)
 		}
-		if crlDistPoints, ok = config["crl_distribution_points"].([]interface{}); !ok {
-			fmt.Fprint(w, "NO\t\n")
-			FatalFlush(w, errors.New("crl_distribution_points was not found"))
+		expectedCA, expectedCRL, err := i.caURLs(i.mount)
+		if err != nil {
+			fmt.Fprint(w, "UNKNOWN\t\n")
+			FatalFlush(w, err)
+		}
+		var config map[string]interface{}
+		if configSecret != nil {
+			config = configSecret.Data
+		}
+		issuingCerts := dataStrings(config["issuing_certificates"])
+		crlDistPoints := dataStrings(config["crl_distribution_points"])
+		switch {
+		case !containsString(issuingCerts, expectedCA):
+			fmt.Fprintf(w, "NO (issuing_certificates was %v, expected %s)\t\n", issuingCerts, expectedCA)
+		case !containsString(crlDistPoints, expectedCRL):
+			fmt.Fprintf(w, "NO (crl_distribution_points was %v, expected %s)\t\n", crlDistPoints, expectedCRL)
+		default:
+			fmt.Fprint(w, "YES\t\n")
 		}
-		expected = fmt.Sprintf("%s/v1/%s/crl", vaultURL, i.mount)
-		found = false
-		for _, d := range crlDistPoints {
-			found = found || d.(string) == expected
+	}
+
+	fmt.Fprint(w, "Intermediate CA cert store size:\t")
+	if !hasIntermediate {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		serials, err := listSerials(i.mount)
+		if err != nil {
+			FatalFlush(w, err)
 		}
-		if !found {
-			fmt.Fprintf(w, "NO\t\n")
-			FatalFlush(w, errors.New("crl_distribution_points was not found"))
+		if len(serials) > i.maxCerts {
+			fmt.Fprintf(w, "%d (WARNING: more than %d, run 'tidy')\t\n", len(serials), i.maxCerts)
+		} else {
+			fmt.Fprintf(w, "%d\t\n", len(serials))
 		}
-		fmt.Fprintf(w, "YES\t\n")
 	}
 	w.Flush()
 }
@@ -323,6 +836,95 @@ func (i *IntermediateCA) removeRun(cmd *cobra.Command, args []string) {
 	w.Flush()
 }
 
+func (i *IntermediateCA) rotateRun(cmd *cobra.Command, args []string) {
+	if i.mount == "" {
+		log.Fatal("--mount was not set.")
+	}
+	if i.newMount == "" {
+		log.Fatal("--new-mount was not set.")
+	}
+	if i.newMount == i.mount {
+		log.Fatal("--new-mount must be different from --mount.")
+	}
+	i.checkSettings()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Reading the current intermediate CA cert:\t")
+	oldCert, err := readCACert(vaultAPI, i.mount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if oldCert == nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, fmt.Errorf("no intermediate CA cert found in %s", i.mount))
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	if i.commonName == "" {
+		i.commonName = oldCert.Subject.CommonName
+	}
+	i.checkRootLifetime(w)
+	i.setup(w, i.newMount)
+
+	fmt.Fprint(w, "Copying roles to the new intermediate CA:\t")
+	maxRoleTTL, err := copyRoles(i.mount, i.newMount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	if i.chainOut != "" {
+		fmt.Fprint(w, "Writing the CA chain bundle:\t")
+		newCert, err := readCACert(vaultAPI, i.newMount)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		rootCert, err := readCACert(vaultAPI, i.rootMount)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if newCert == nil || rootCert == nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, errors.New("could not read the new intermediate CA cert or the root CA cert"))
+		}
+		var bundle []byte
+		for _, c := range []*x509.Certificate{newCert, oldCert, rootCert} {
+			bundle = append(bundle, encodeCertPEM(c)...)
+		}
+		if err = writeFilesAtomic(&outputFile{path: i.chainOut, contents: bundle, perm: 0644}); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+
+	fmt.Fprint(w, "Switching 'generate tls' to the new intermediate CA on this host:\t")
+	switchedIn, err := switchTLSMount(i.mount, i.newMount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+	fmt.Fprintf(w, "Switch recorded in:\t%s\t\n", switchedIn)
+
+	// Certs issued by the old intermediate CA can't outlive it, and no new
+	// certs will be issued by it, so the longest role max TTL bounds the
+	// lifetime of the remaining certs.
+	retireAt := oldCert.NotAfter
+	if maxRoleTTL > 0 {
+		if t := time.Now().Add(maxRoleTTL); t.Before(retireAt) {
+			retireAt = t
+		}
+	}
+	fmt.Fprintf(w, "Old intermediate CA can be retired after:\t%s\t\n", retireAt.Format(time.RFC3339))
+	w.Flush()
+}
+
 var intermediate *IntermediateCA
 
 func init() {
@@ -330,4 +932,6 @@ func init() {
 	removeCmd.AddCommand(intermediate.Remove)
 	initCmd.AddCommand(intermediate.Init)
 	checkCmd.AddCommand(intermediate.Check)
+	rotateCmd.AddCommand(intermediate.Rotate)
+	importCmd.AddCommand(intermediate.Import)
 }
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The annotations that de-vault records on the Secret manifests it generates,
+// so that 'check tls' and 'renew tls' can work from the manifest alone.
+const (
+	annotationSerial   = "de-vault.cyverse.org/serial-number"
+	annotationMount    = "de-vault.cyverse.org/mount"
+	annotationRole     = "de-vault.cyverse.org/role"
+	annotationNotAfter = "de-vault.cyverse.org/not-after"
+)
+
+// k8sSecret is a Kubernetes Secret manifest. Only the fields used for TLS
+// secrets are included; the rest of a manifest read from a file are kept in raw
+// so that they can be written back unchanged.
+type k8sSecret struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	Data       map[string]string `yaml:"data"`
+
+	raw map[interface{}]interface{}
+}
+
+// k8sMetadata is the metadata of a Kubernetes object.
+type k8sMetadata struct {
+	Name        string            `yaml:"name"`
+	Namespace   string            `yaml:"namespace,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// newTLSSecret returns a kubernetes.io/tls Secret with the given name and
+// namespace. The namespace is left out of the manifest if it's empty.
+func newTLSSecret(name, namespace string) *k8sSecret {
+	return &k8sSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: k8sMetadata{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Type: "kubernetes.io/tls",
+	}
+}
+
+// setCert replaces the cert, key, and CA certs in the secret with the ones in
+// the response to an issue request and annotates the secret with where the
+// cert came from.
+func (s *k8sSecret) setCert(certSecret *vault.Secret, mount, role string, caChain []*x509.Certificate) error {
+	cert, err := parseCertPEM(certSecret.Data["certificate"].(string))
+	if err != nil {
+		return err
+	}
+	keyPEM, ok := certSecret.Data["private_key"].(string)
+	if !ok {
+		return errors.New("no private key found")
+	}
+	var caPEM bytes.Buffer
+	for _, c := range caChain {
+		caPEM.Write(encodeCertPEM(c))
+	}
+
+	s.Data = map[string]string{
+		"tls.crt": base64.StdEncoding.EncodeToString(certChainPEM(certSecret)),
+		"tls.key": base64.StdEncoding.EncodeToString([]byte(keyPEM + "\n")),
+		"ca.crt":  base64.StdEncoding.EncodeToString(caPEM.Bytes()),
+	}
+	if s.Metadata.Annotations == nil {
+		s.Metadata.Annotations = map[string]string{}
+	}
+	s.Metadata.Annotations[annotationSerial] = formatSerial(cert.SerialNumber)
+	s.Metadata.Annotations[annotationMount] = mount
+	s.Metadata.Annotations[annotationRole] = role
+	s.Metadata.Annotations[annotationNotAfter] = cert.NotAfter.Format(time.RFC3339)
+	return nil
+}
+
+// cert returns the first cert in the secret's tls.crt.
+func (s *k8sSecret) cert() (*x509.Certificate, error) {
+	encoded, ok := s.Data["tls.crt"]
+	if !ok {
+		return nil, errors.New("no tls.crt found in the secret")
+	}
+	contents, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertPEM(string(contents))
+}
+
+// key returns the PEM-encoded private key in the secret's tls.key.
+func (s *k8sSecret) key() (string, error) {
+	encoded, ok := s.Data["tls.key"]
+	if !ok {
+		return "", errors.New("no tls.key found in the secret")
+	}
+	contents, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(contents), nil
+}
+
+// readTLSSecret reads a kubernetes.io/tls Secret manifest from the file at p.
+func readTLSSecret(p string) (*k8sSecret, error) {
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	s := &k8sSecret{}
+	if err = yaml.Unmarshal(contents, s); err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(contents, &s.raw); err != nil {
+		return nil, err
+	}
+	if s.Kind != "Secret" || s.Type != "kubernetes.io/tls" {
+		return nil, fmt.Errorf("%s is not a kubernetes.io/tls Secret", p)
+	}
+	return s, nil
+}
+
+// rawMap returns the map stored under key in m, adding an empty one if it's
+// missing.
+func rawMap(m map[interface{}]interface{}, key string) map[interface{}]interface{} {
+	child, ok := m[key].(map[interface{}]interface{})
+	if !ok {
+		child = map[interface{}]interface{}{}
+		m[key] = child
+	}
+	return child
+}
+
+// rawManifest returns the manifest read from the file with the data and the
+// annotations of the secret merged in. Any stringData entries for the same
+// keys are removed, since they would override the data when applied.
+func (s *k8sSecret) rawManifest() map[interface{}]interface{} {
+	data := rawMap(s.raw, "data")
+	stringData, _ := s.raw["stringData"].(map[interface{}]interface{})
+	for k, v := range s.Data {
+		data[k] = v
+		delete(stringData, k)
+	}
+	annotations := rawMap(rawMap(s.raw, "metadata"), "annotations")
+	for k, v := range s.Metadata.Annotations {
+		annotations[k] = v
+	}
+	return s.raw
+}
+
+// writeTLSSecret writes the secret manifest to the file at p. The file is only
+// readable by the owner since the secret contains the private key. A manifest
+// read with readTLSSecret keeps the fields that de-vault doesn't manage, such
+// as labels, stringData, and immutable.
+func writeTLSSecret(p string, s *k8sSecret) error {
+	var manifest interface{} = s
+	if s.raw != nil {
+		manifest = s.rawManifest()
+	}
+	contents, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFilesAtomic(&outputFile{path: p, contents: contents, perm: 0600})
+}
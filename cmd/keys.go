@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/cyverse-de/vaulter"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/spf13/pflag"
+)
+
+const defaultKeyType = "rsa"
+
+// defaultKeyBits maps key types to the key size used when --key-bits is unset.
+var defaultKeyBits = map[string]int{
+	"rsa": 4096,
+	"ec":  256,
+}
+
+// validKeyBits lists the key sizes supported for each key type.
+var validKeyBits = map[string][]int{
+	"rsa": {2048, 3072, 4096},
+	"ec":  {256, 384},
+}
+
+// keySettings contains the type and size of a key generated by Vault.
+type keySettings struct {
+	keyType string
+	keyBits int
+}
+
+// addFlags registers the --key-type and --key-bits flags with the flag set.
+func (k *keySettings) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(
+		&k.keyType,
+		"key-type",
+		defaultKeyType,
+		"The type of key to generate. Either rsa or ec.",
+	)
+	flags.IntVar(
+		&k.keyBits,
+		"key-bits",
+		0,
+		"The size of the key to generate. Defaults to 4096 for rsa and 256 for ec.",
+	)
+}
+
+// validate fills in the default key size if necessary and returns an error if
+// the key type and size are not a supported combination.
+func (k *keySettings) validate() error {
+	sizes, ok := validKeyBits[k.keyType]
+	if !ok {
+		return fmt.Errorf("unsupported key type %s", k.keyType)
+	}
+	if k.keyBits == 0 {
+		k.keyBits = defaultKeyBits[k.keyType]
+	}
+	for _, s := range sizes {
+		if s == k.keyBits {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported key size %d for key type %s", k.keyBits, k.keyType)
+}
+
+// String returns a description of the key settings, e.g. "rsa 4096".
+func (k *keySettings) String() string {
+	return fmt.Sprintf("%s %d", k.keyType, k.keyBits)
+}
+
+// certKeySettings returns the key type and size of the public key in the cert.
+func certKeySettings(c *x509.Certificate) *keySettings {
+	switch pub := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return &keySettings{keyType: "rsa", keyBits: pub.N.BitLen()}
+	case *ecdsa.PublicKey:
+		return &keySettings{keyType: "ec", keyBits: pub.Curve.Params().BitSize}
+	}
+	return &keySettings{keyType: "unknown"}
+}
+
+// checkRoleKey returns an error if the keys that Vault generates with the role
+// don't match the key type or size. An empty key type or a key size of 0 isn't
+// checked, and a role with key_type any or key_bits 0 matches every key type or
+// size respectively.
+func checkRoleKey(role map[string]interface{}, keyType string, keyBits int) error {
+	roleType, _ := role["key_type"].(string)
+	if keyType != "" && roleType != "" && roleType != "any" && roleType != keyType {
+		return fmt.Errorf("the role generates %s keys, but --key-type is %s", roleType, keyType)
+	}
+	roleBits := fmt.Sprint(role["key_bits"])
+	if keyBits != 0 && role["key_bits"] != nil && roleBits != "0" && roleBits != strconv.Itoa(keyBits) {
+		return fmt.Errorf("the role generates %s-bit keys, but --key-bits is %d", roleBits, keyBits)
+	}
+	return nil
+}
+
+// generateKey generates a private key with the key settings locally rather
+// than in Vault. The settings must have been validated.
+func (k *keySettings) generateKey() (crypto.Signer, error) {
+	switch k.keyType {
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, k.keyBits)
+	case "ec":
+		curve := elliptic.P256()
+		if k.keyBits == 384 {
+			curve = elliptic.P384()
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.keyType)
+}
+
+// encodeKeyPEM returns the PEM encoding of the private key, in the same
+// formats that Vault uses for the keys it generates.
+func encodeKeyPEM(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+	return nil, errors.New("unsupported private key type")
+}
+
+// parseKeyPEM decodes a PEM-encoded RSA or EC private key.
+func parseKeyPEM(contents string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(contents))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported private key type %s", block.Type)
+}
+
+// rootCACert generates the root CA cert and key with the backend mounted at
+// mountPath. It differs from vaulter.RootCACert in that it sets the key type.
+func rootCACert(m vaulter.MountReaderWriter, mountPath string, c *vaulter.RootCACertConfig, keyType string) (*vault.Secret, error) {
+	path := fmt.Sprintf("%s/root/generate/internal", mountPath)
+	data := map[string]interface{}{
+		"common_name":          c.CommonName,
+		"ttl":                  c.TTL,
+		"key_type":             keyType,
+		"key_bits":             c.KeyBits,
+		"exclude_cn_from_sans": c.ExcludeCNFromSans,
+	}
+	return m.Write(m.Client(), path, data)
+}
+
+// intermediateCSR generates a CSR for an intermediate CA with the backend
+// mounted at mountPath. It differs from vaulter.CSR in that it sets the key
+// type.
+func intermediateCSR(m vaulter.MountReaderWriter, mountPath string, c *vaulter.CSRConfig, keyType string) (*vault.Secret, error) {
+	path := fmt.Sprintf("%s/intermediate/generate/internal", mountPath)
+	data := map[string]interface{}{
+		"common_name":          c.CommonName,
+		"ttl":                  c.TTL,
+		"key_type":             keyType,
+		"key_bits":             c.KeyBits,
+		"exclude_cn_from_sans": c.ExcludeCNFromSans,
+	}
+	return m.Write(m.Client(), path, data)
+}
+
+// createRole creates or updates a role. It differs from vaulter.CreateRole in
+// that it sets the key type and the max TTL.
+func createRole(m vaulter.MountReaderWriter, mountPath, roleName string, c *vaulter.RoleConfig, keyType string) (*vault.Secret, error) {
+	path := fmt.Sprintf("%s/roles/%s", mountPath, roleName)
+	data := map[string]interface{}{
+		"allowed_domains":  c.AllowedDomains,
+		"allow_subdomains": strconv.FormatBool(c.AllowSubdomains),
+		"key_type":         keyType,
+		"key_bits":         c.KeyBits,
+		"allow_any_name":   strconv.FormatBool(c.AllowAnyName),
+	}
+	if c.MaxTTL != "" {
+		data["max_ttl"] = c.MaxTTL
+	}
+	return m.Write(m.Client(), path, data)
+}
+
+// readCACert reads and parses the CA cert for the backend mounted at
+// mountPath. Returns nil if the backend does not have a CA cert.
+func readCACert(m vaulter.MountReaderWriter, mountPath string) (*x509.Certificate, error) {
+	secret, err := m.Read(m.Client(), fmt.Sprintf("%s/cert/ca", mountPath))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	contents, ok := secret.Data["certificate"].(string)
+	if !ok || contents == "" {
+		return nil, nil
+	}
+	return parseCertPEM(contents)
+}
@@ -0,0 +1,521 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// The PKCS#12 and JKS encoders below only implement what's needed to write out
+// keystores and truststores that Java and OpenSSL can read. The standard
+// library doesn't provide them and neither does anything that's vendored.
+
+var (
+	oidRSAEncryption        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECPublicKey          = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidDataContentType      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidShroudedKeyBag       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3KeyDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidJavaTrustedKeyUsage  = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUsage  = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	oidJKSKeyProtector      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+	asn1Null                = asn1.RawValue{Tag: asn1.TagNull}
+)
+
+const (
+	keystoreIterations = 2048
+	jksMagic           = 0xfeedfeed
+)
+
+// keystoreEntry is an entry in a PKCS#12 or JKS keystore. Entries with a key
+// are private key entries holding the key and its cert chain, starting with
+// the cert for the key. Entries without a key are trusted cert entries and
+// only use the first cert in the chain.
+type keystoreEntry struct {
+	alias string
+	key   []byte
+	chain []*x509.Certificate
+}
+
+type privateKeyInfo struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// readKeystorePassword reads the keystore password from the first line of the
+// file at p.
+func readKeystorePassword(p string) (string, error) {
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimRight(strings.SplitN(string(contents), "\n", 2)[0], "\r")
+	if password == "" {
+		return "", fmt.Errorf("%s does not contain a password", p)
+	}
+	return password, nil
+}
+
+// pkcs8Key converts the PEM-encoded RSA or EC private key returned by Vault
+// into a DER-encoded PKCS#8 PrivateKeyInfo, which is what both keystore
+// formats expect.
+func pkcs8Key(keyPEM string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("no PEM data found in the private key")
+	}
+	info := privateKeyInfo{PrivateKey: block.Bytes}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+		info.Algorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1Null}
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var curve asn1.ObjectIdentifier
+		switch key.Curve {
+		case elliptic.P224():
+			curve = asn1.ObjectIdentifier{1, 3, 132, 0, 33}
+		case elliptic.P256():
+			curve = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+		case elliptic.P384():
+			curve = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+		case elliptic.P521():
+			curve = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+		default:
+			return nil, errors.New("unsupported elliptic curve")
+		}
+		params, err := asn1.Marshal(curve)
+		if err != nil {
+			return nil, err
+		}
+		info.Algorithm = pkix.AlgorithmIdentifier{Algorithm: oidECPublicKey, Parameters: asn1.RawValue{FullBytes: params}}
+	default:
+		return nil, fmt.Errorf("unsupported private key type %s", block.Type)
+	}
+	return asn1.Marshal(info)
+}
+
+// truststoreEntries returns a trusted cert entry for each cert, using the
+// common names as aliases. The names are lowercased, trimmed, and have their
+// runs of whitespace replaced with dashes, so "DE Root CA" becomes de-root-ca.
+func truststoreEntries(certs []*x509.Certificate) []keystoreEntry {
+	var entries []keystoreEntry
+	used := map[string]bool{}
+	for _, c := range certs {
+		base := strings.Join(strings.Fields(strings.ToLower(c.Subject.CommonName)), "-")
+		if base == "" {
+			base = "ca"
+		}
+		alias := base
+		for i := 2; used[alias]; i++ {
+			alias = fmt.Sprintf("%s-%d", base, i)
+		}
+		used[alias] = true
+		entries = append(entries, keystoreEntry{alias: alias, chain: []*x509.Certificate{c}})
+	}
+	return entries
+}
+
+// bmpString encodes s as UTF-16 big endian, the encoding used for BMPStrings
+// and for passwords in both keystore formats.
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return b
+}
+
+// pkcs12KDF derives key material from a password as described in RFC 7292,
+// appendix B.2, using SHA-1. The id selects the purpose of the material: 1
+// for encryption keys, 2 for IVs and 3 for MAC keys.
+func pkcs12KDF(password, salt []byte, iterations int, id byte, size int) []byte {
+	const v = 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+	var out []byte
+	for len(out) < size {
+		h := sha1.New()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		out = append(out, a...)
+		if len(out) >= size {
+			break
+		}
+
+		// Each block of i is replaced with (block + b + 1) mod 2^(v*8).
+		b := fill(a)
+		for k := 0; k < len(i); k += v {
+			carry := 1
+			for m := v - 1; m >= 0; m-- {
+				sum := int(i[k+m]) + int(b[m]) + carry
+				i[k+m] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return out[:size]
+}
+
+// pkcs12Password returns the password in the form used by the PKCS#12 KDF, a
+// null-terminated BMPString.
+func pkcs12Password(password string) []byte {
+	return append(bmpString(password), 0, 0)
+}
+
+// encryptPKCS12Key encrypts a PKCS#8 private key with
+// pbeWithSHAAnd3-KeyTripleDES-CBC.
+func encryptPKCS12Key(key []byte, password string) ([]byte, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	pw := pkcs12Password(password)
+	block, err := des.NewTripleDESCipher(pkcs12KDF(pw, salt, keystoreIterations, 1, 24))
+	if err != nil {
+		return nil, err
+	}
+	padLen := block.BlockSize() - len(key)%block.BlockSize()
+	encrypted := append(append([]byte{}, key...), bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	iv := pkcs12KDF(pw, salt, keystoreIterations, 2, block.BlockSize())
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: keystoreIterations})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBEWithSHAAnd3KeyDES,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: encrypted,
+	})
+}
+
+// explicitContent wraps DER-encoded contents in a [0] EXPLICIT tag. RawValues
+// are marshalled as-is, so the tag in the struct field is only used when
+// unmarshalling.
+func explicitContent(contents []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: contents}
+}
+
+// pkcs12Attr returns a bag attribute with a single value.
+func pkcs12Attr(id asn1.ObjectIdentifier, value interface{}) (pkcs12Attribute, error) {
+	var (
+		contents []byte
+		err      error
+	)
+	if s, ok := value.(string); ok {
+		contents, err = asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(s)})
+	} else {
+		contents, err = asn1.Marshal(value)
+	}
+	if err != nil {
+		return pkcs12Attribute{}, err
+	}
+	return pkcs12Attribute{
+		ID:    id,
+		Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: contents},
+	}, nil
+}
+
+// newCertBag returns a safe bag containing the cert.
+func newCertBag(c *x509.Certificate, attrs ...pkcs12Attribute) (safeBag, error) {
+	contents, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: c.Raw})
+	if err != nil {
+		return safeBag{}, err
+	}
+	return safeBag{ID: oidCertBag, Value: explicitContent(contents), Attributes: attrs}, nil
+}
+
+// dataContentInfo returns an unencrypted ContentInfo holding the bags.
+func dataContentInfo(bags []safeBag) (contentInfo, error) {
+	contents, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	octets, err := asn1.Marshal(contents)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{ContentType: oidDataContentType, Content: explicitContent(octets)}, nil
+}
+
+// encodePKCS12 returns a PKCS#12 keystore containing the entries. Private keys
+// are encrypted with the password, which also protects the integrity of the
+// keystore. Trusted cert entries are marked the way Java expects so that the
+// keystore can be used as a truststore.
+func encodePKCS12(entries []keystoreEntry, password string) ([]byte, error) {
+	var keyBags, certBags []safeBag
+	for _, e := range entries {
+		if len(e.chain) == 0 {
+			return nil, fmt.Errorf("no certs for keystore entry %s", e.alias)
+		}
+		name, err := pkcs12Attr(oidFriendlyName, e.alias)
+		if err != nil {
+			return nil, err
+		}
+
+		if e.key == nil {
+			usage, err := pkcs12Attr(oidJavaTrustedKeyUsage, oidAnyExtendedKeyUsage)
+			if err != nil {
+				return nil, err
+			}
+			bag, err := newCertBag(e.chain[0], name, usage)
+			if err != nil {
+				return nil, err
+			}
+			certBags = append(certBags, bag)
+			continue
+		}
+
+		keyID := sha1.Sum(e.chain[0].Raw)
+		localKeyID, err := pkcs12Attr(oidLocalKeyID, keyID[:])
+		if err != nil {
+			return nil, err
+		}
+		encrypted, err := encryptPKCS12Key(e.key, password)
+		if err != nil {
+			return nil, err
+		}
+		keyBags = append(keyBags, safeBag{
+			ID:         oidShroudedKeyBag,
+			Value:      explicitContent(encrypted),
+			Attributes: []pkcs12Attribute{name, localKeyID},
+		})
+		for idx, c := range e.chain {
+			var attrs []pkcs12Attribute
+			if idx == 0 {
+				attrs = []pkcs12Attribute{name, localKeyID}
+			}
+			bag, err := newCertBag(c, attrs...)
+			if err != nil {
+				return nil, err
+			}
+			certBags = append(certBags, bag)
+		}
+	}
+
+	var authSafe []contentInfo
+	for _, bags := range [][]safeBag{certBags, keyBags} {
+		if len(bags) == 0 {
+			continue
+		}
+		ci, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, ci)
+	}
+	authSafeContents, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	octets, err := asn1.Marshal(authSafeContents)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt := make([]byte, 8)
+	if _, err = rand.Read(macSalt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pkcs12KDF(pkcs12Password(password), macSalt, keystoreIterations, 3, sha1.Size))
+	mac.Write(authSafeContents)
+
+	return asn1.Marshal(pfxPdu{
+		Version:  3,
+		AuthSafe: contentInfo{ContentType: oidDataContentType, Content: explicitContent(octets)},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1Null},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: keystoreIterations,
+		},
+	})
+}
+
+// protectJKSKey encrypts a PKCS#8 private key with the proprietary algorithm
+// used by Sun's KeyProtector: the key is XORed with a SHA-1 based keystream
+// derived from the password and a random salt, and followed by a SHA-1 digest
+// of the password and the plaintext key.
+func protectJKSKey(key []byte, password string) ([]byte, error) {
+	pw := bmpString(password)
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, len(key))
+	digest := salt
+	for offset := 0; offset < len(key); offset += sha1.Size {
+		h := sha1.New()
+		h.Write(pw)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for i := 0; i < sha1.Size && offset+i < len(key); i++ {
+			encrypted[offset+i] = key[offset+i] ^ digest[i]
+		}
+	}
+
+	h := sha1.New()
+	h.Write(pw)
+	h.Write(key)
+
+	var protected []byte
+	protected = append(protected, salt...)
+	protected = append(protected, encrypted...)
+	protected = append(protected, h.Sum(nil)...)
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1Null},
+		EncryptedData: protected,
+	})
+}
+
+// encodeJKS returns a Java keystore containing the entries. Private keys are
+// protected with the password, which also protects the integrity of the
+// keystore. Java lowercases aliases when loading a JKS file, so they're
+// lowercased here as well.
+func encodeJKS(entries []keystoreEntry, password string) ([]byte, error) {
+	var buf bytes.Buffer
+	writeUTF := func(s string) {
+		binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+		buf.WriteString(s)
+	}
+	writeCert := func(c *x509.Certificate) {
+		writeUTF("X.509")
+		binary.Write(&buf, binary.BigEndian, uint32(len(c.Raw)))
+		buf.Write(c.Raw)
+	}
+
+	binary.Write(&buf, binary.BigEndian, uint32(jksMagic))
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+	binary.Write(&buf, binary.BigEndian, uint32(len(entries)))
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, e := range entries {
+		if len(e.chain) == 0 {
+			return nil, fmt.Errorf("no certs for keystore entry %s", e.alias)
+		}
+		if e.key == nil {
+			binary.Write(&buf, binary.BigEndian, uint32(2))
+			writeUTF(strings.ToLower(e.alias))
+			binary.Write(&buf, binary.BigEndian, timestamp)
+			writeCert(e.chain[0])
+			continue
+		}
+
+		protected, err := protectJKSKey(e.key, password)
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(1))
+		writeUTF(strings.ToLower(e.alias))
+		binary.Write(&buf, binary.BigEndian, timestamp)
+		binary.Write(&buf, binary.BigEndian, uint32(len(protected)))
+		buf.Write(protected)
+		binary.Write(&buf, binary.BigEndian, uint32(len(e.chain)))
+		for _, c := range e.chain {
+			writeCert(c)
+		}
+	}
+
+	h := sha1.New()
+	h.Write(bmpString(password))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+	return buf.Bytes(), nil
+}
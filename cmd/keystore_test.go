@@ -0,0 +1,534 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// jksEntry is an entry read back from a JKS keystore by readJKS.
+type jksEntry struct {
+	tag   uint32
+	alias string
+	key   []byte
+	chain []*x509.Certificate
+}
+
+// jksReader reads the big endian values that a JKS keystore is made of.
+type jksReader struct {
+	r   io.Reader
+	err error
+}
+
+func (j *jksReader) uint32() uint32 {
+	var v uint32
+	if j.err == nil {
+		j.err = binary.Read(j.r, binary.BigEndian, &v)
+	}
+	return v
+}
+
+func (j *jksReader) bytes(n int) []byte {
+	b := make([]byte, n)
+	if j.err == nil {
+		_, j.err = io.ReadFull(j.r, b)
+	}
+	return b
+}
+
+func (j *jksReader) utf() string {
+	var n uint16
+	if j.err == nil {
+		j.err = binary.Read(j.r, binary.BigEndian, &n)
+	}
+	return string(j.bytes(int(n)))
+}
+
+func (j *jksReader) cert() *x509.Certificate {
+	if certType := j.utf(); j.err == nil && certType != "X.509" {
+		j.err = fmt.Errorf("unexpected cert type %s", certType)
+	}
+	raw := j.bytes(int(j.uint32()))
+	if j.err != nil {
+		return nil
+	}
+	var c *x509.Certificate
+	c, j.err = x509.ParseCertificate(raw)
+	return c
+}
+
+// recoverJKSKey reverses the KeyProtector encryption done by protectJKSKey and
+// checks the digest of the plaintext key.
+func recoverJKSKey(protected []byte, password string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(protected, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidJKSKeyProtector) {
+		return nil, fmt.Errorf("unexpected key algorithm %s", info.Algorithm.Algorithm)
+	}
+	data := info.EncryptedData
+	if len(data) < 2*sha1.Size {
+		return nil, errors.New("protected key is too short")
+	}
+	pw := bmpString(password)
+	salt := data[:sha1.Size]
+	encrypted := data[sha1.Size : len(data)-sha1.Size]
+	check := data[len(data)-sha1.Size:]
+
+	key := make([]byte, len(encrypted))
+	digest := salt
+	for offset := 0; offset < len(encrypted); offset += sha1.Size {
+		digest = sha1Sum(pw, digest)
+		for i := 0; i < sha1.Size && offset+i < len(encrypted); i++ {
+			key[offset+i] = encrypted[offset+i] ^ digest[i]
+		}
+	}
+	if !bytes.Equal(sha1Sum(pw, key), check) {
+		return nil, errors.New("protected key digest does not match")
+	}
+	return key, nil
+}
+
+func sha1Sum(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// readJKS parses a JKS keystore the way Java's JavaKeyStore.engineLoad does,
+// checking the SHA-1 integrity digest at the end of the file.
+func readJKS(data []byte, password string) ([]jksEntry, error) {
+	if len(data) < sha1.Size {
+		return nil, errors.New("keystore is too short")
+	}
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	if !bytes.Equal(sha1Sum(bmpString(password), []byte("Mighty Aphrodite"), body), digest) {
+		return nil, errors.New("keystore integrity digest does not match")
+	}
+
+	r := bytes.NewReader(body)
+	j := &jksReader{r: r}
+	if magic := j.uint32(); j.err == nil && magic != jksMagic {
+		return nil, fmt.Errorf("unexpected magic number %x", magic)
+	}
+	if version := j.uint32(); j.err == nil && version != 2 {
+		return nil, fmt.Errorf("unexpected version %d", version)
+	}
+	count := j.uint32()
+	var entries []jksEntry
+	for i := uint32(0); i < count && j.err == nil; i++ {
+		e := jksEntry{tag: j.uint32(), alias: j.utf()}
+		j.bytes(8)
+		switch e.tag {
+		case 1:
+			protected := j.bytes(int(j.uint32()))
+			if j.err != nil {
+				break
+			}
+			if e.key, j.err = recoverJKSKey(protected, password); j.err != nil {
+				break
+			}
+			for n := j.uint32(); n > 0 && j.err == nil; n-- {
+				e.chain = append(e.chain, j.cert())
+			}
+		case 2:
+			e.chain = append(e.chain, j.cert())
+		default:
+			j.err = fmt.Errorf("unexpected entry tag %d", e.tag)
+		}
+		entries = append(entries, e)
+	}
+	if j.err != nil {
+		return nil, j.err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after the entries", r.Len())
+	}
+	return entries, nil
+}
+
+// testCert returns a PKCS#8 encoded key and a self-signed cert for it.
+func testCert(t *testing.T, cn string) ([]byte, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodeKeyPEM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := pkcs8Key(string(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkcs8, cert
+}
+
+func TestEncodeJKS(t *testing.T) {
+	key, cert := testCert(t, "Example Service")
+	_, caCert := testCert(t, "Example CA")
+	entries := []keystoreEntry{
+		{alias: "Service", key: key, chain: []*x509.Certificate{cert, caCert}},
+		{alias: "CA", chain: []*x509.Certificate{caCert}},
+	}
+
+	data, err := encodeJKS(entries, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := readJKS(data, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(read))
+	}
+
+	if read[0].tag != 1 || read[0].alias != "service" {
+		t.Errorf("expected private key entry service, got tag %d alias %s", read[0].tag, read[0].alias)
+	}
+	if !bytes.Equal(read[0].key, key) {
+		t.Error("private key does not round-trip")
+	}
+	if len(read[0].chain) != 2 || !read[0].chain[0].Equal(cert) || !read[0].chain[1].Equal(caCert) {
+		t.Error("cert chain does not round-trip")
+	}
+
+	if read[1].tag != 2 || read[1].alias != "ca" {
+		t.Errorf("expected trusted cert entry ca, got tag %d alias %s", read[1].tag, read[1].alias)
+	}
+	if len(read[1].chain) != 1 || !read[1].chain[0].Equal(caCert) {
+		t.Error("trusted cert does not round-trip")
+	}
+}
+
+func TestEncodeJKSIntegrity(t *testing.T) {
+	key, cert := testCert(t, "Example Service")
+	data, err := encodeJKS([]keystoreEntry{{alias: "service", key: key, chain: []*x509.Certificate{cert}}}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = readJKS(data, "wrong"); err == nil {
+		t.Error("expected the integrity check to fail with the wrong password")
+	}
+
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)/2] ^= 0xff
+	if _, err = readJKS(tampered, "s3cret"); err == nil {
+		t.Error("expected the integrity check to fail for a modified keystore")
+	}
+}
+
+func TestTruststoreEntries(t *testing.T) {
+	_, rootCert := testCert(t, "DE Root CA")
+	_, spacedCert := testCert(t, "  Example \t  CA ")
+	_, dupCert := testCert(t, "example ca")
+	_, unnamedCert := testCert(t, "")
+
+	entries := truststoreEntries([]*x509.Certificate{rootCert, spacedCert, dupCert, unnamedCert})
+	expected := []string{"de-root-ca", "example-ca", "example-ca-2", "ca"}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for i, e := range entries {
+		if e.alias != expected[i] {
+			t.Errorf("expected alias %q, got %q", expected[i], e.alias)
+		}
+		if e.key != nil || len(e.chain) != 1 {
+			t.Errorf("expected %s to be a trusted cert entry", e.alias)
+		}
+	}
+}
+
+func TestPKCS12KDF(t *testing.T) {
+	// The expected values were printed by 'openssl kdf PKCS12KDF' with the
+	// same password, salt, and iteration count.
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tests := []struct {
+		id       byte
+		expected string
+	}{
+		{1, "088732fb5851abfa412dd301ba88e4c46212bcec3c1eedaf"},
+		{2, "501abc39f36f9acd2ceacb3e895ce1638aa41d41fa846f14"},
+		{3, "b4104d31b3b9de4320e11656946a82f10cca875711a8048e"},
+	}
+	for _, test := range tests {
+		actual := hex.EncodeToString(pkcs12KDF(pkcs12Password("s3cret"), salt, 2048, test.id, 24))
+		if actual != test.expected {
+			t.Errorf("id %d: expected %s, got %s", test.id, test.expected, actual)
+		}
+	}
+}
+
+// pkcs12Bag is a safe bag read back from a PKCS#12 keystore by readPKCS12,
+// with its attributes decoded.
+type pkcs12Bag struct {
+	id           asn1.ObjectIdentifier
+	value        []byte
+	friendlyName string
+	localKeyID   []byte
+	trustedUsage bool
+}
+
+// unmarshalAll unmarshals der into v and fails if anything is left over.
+func unmarshalAll(der []byte, v interface{}) error {
+	rest, err := asn1.Unmarshal(der, v)
+	if err == nil && len(rest) != 0 {
+		err = fmt.Errorf("%d trailing bytes", len(rest))
+	}
+	return err
+}
+
+// dataContent returns the contents of the OCTET STRING in a data ContentInfo.
+func dataContent(ci contentInfo) ([]byte, error) {
+	if !ci.ContentType.Equal(oidDataContentType) {
+		return nil, fmt.Errorf("unexpected content type %s", ci.ContentType)
+	}
+	var octets []byte
+	if err := unmarshalAll(ci.Content.Bytes, &octets); err != nil {
+		return nil, err
+	}
+	return octets, nil
+}
+
+func decodeBMPString(b []byte) string {
+	var u []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(u))
+}
+
+// readPKCS12 parses a PKCS#12 keystore, checking its MAC with the password the
+// way RFC 7292 describes, and returns its bags.
+func readPKCS12(data []byte, password string) ([]pkcs12Bag, error) {
+	var pfx pfxPdu
+	if err := unmarshalAll(data, &pfx); err != nil {
+		return nil, err
+	}
+	if pfx.Version != 3 {
+		return nil, fmt.Errorf("unexpected version %d", pfx.Version)
+	}
+	authSafeContents, err := dataContent(pfx.AuthSafe)
+	if err != nil {
+		return nil, err
+	}
+	if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidSHA1) {
+		return nil, fmt.Errorf("unexpected MAC algorithm %s", pfx.MacData.Mac.Algorithm.Algorithm)
+	}
+	key := pkcs12KDF(pkcs12Password(password), pfx.MacData.MacSalt, pfx.MacData.Iterations, 3, sha1.Size)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(authSafeContents)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		return nil, errors.New("keystore MAC does not match")
+	}
+
+	var authSafe []contentInfo
+	if err = unmarshalAll(authSafeContents, &authSafe); err != nil {
+		return nil, err
+	}
+	var bags []pkcs12Bag
+	for _, ci := range authSafe {
+		contents, err := dataContent(ci)
+		if err != nil {
+			return nil, err
+		}
+		var safeBags []safeBag
+		if err = unmarshalAll(contents, &safeBags); err != nil {
+			return nil, err
+		}
+		for _, sb := range safeBags {
+			bag := pkcs12Bag{id: sb.ID, value: sb.Value.Bytes}
+			for _, attr := range sb.Attributes {
+				var value asn1.RawValue
+				if err = unmarshalAll(attr.Value.Bytes, &value); err != nil {
+					return nil, err
+				}
+				switch {
+				case attr.ID.Equal(oidFriendlyName) && value.Tag == asn1.TagBMPString:
+					bag.friendlyName = decodeBMPString(value.Bytes)
+				case attr.ID.Equal(oidLocalKeyID) && value.Tag == asn1.TagOctetString:
+					bag.localKeyID = value.Bytes
+				case attr.ID.Equal(oidJavaTrustedKeyUsage):
+					var usage asn1.ObjectIdentifier
+					if err = unmarshalAll(value.FullBytes, &usage); err != nil {
+						return nil, err
+					}
+					bag.trustedUsage = usage.Equal(oidAnyExtendedKeyUsage)
+				default:
+					return nil, fmt.Errorf("unexpected bag attribute %s", attr.ID)
+				}
+			}
+			bags = append(bags, bag)
+		}
+	}
+	return bags, nil
+}
+
+// bagCert returns the cert in a cert bag.
+func bagCert(bag pkcs12Bag) (*x509.Certificate, error) {
+	if !bag.id.Equal(oidCertBag) {
+		return nil, fmt.Errorf("unexpected bag type %s", bag.id)
+	}
+	var cb certBag
+	if err := unmarshalAll(bag.value, &cb); err != nil {
+		return nil, err
+	}
+	if !cb.ID.Equal(oidX509Certificate) {
+		return nil, fmt.Errorf("unexpected cert type %s", cb.ID)
+	}
+	return x509.ParseCertificate(cb.Data)
+}
+
+// decryptPKCS12Key reverses encryptPKCS12Key.
+func decryptPKCS12Key(bag pkcs12Bag, password string) ([]byte, error) {
+	if !bag.id.Equal(oidShroudedKeyBag) {
+		return nil, fmt.Errorf("unexpected bag type %s", bag.id)
+	}
+	var info encryptedPrivateKeyInfo
+	if err := unmarshalAll(bag.value, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBEWithSHAAnd3KeyDES) {
+		return nil, fmt.Errorf("unexpected key algorithm %s", info.Algorithm.Algorithm)
+	}
+	var params pbeParams
+	if err := unmarshalAll(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	pw := pkcs12Password(password)
+	block, err := des.NewTripleDESCipher(pkcs12KDF(pw, params.Salt, params.Iterations, 1, 24))
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("encrypted key is not a whole number of blocks")
+	}
+	iv := pkcs12KDF(pw, params.Salt, params.Iterations, 2, block.BlockSize())
+	key := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(key, data)
+	padLen := int(key[len(key)-1])
+	if padLen == 0 || padLen > block.BlockSize() || !bytes.Equal(key[len(key)-padLen:], bytes.Repeat([]byte{byte(padLen)}, padLen)) {
+		return nil, errors.New("bad padding in the decrypted key")
+	}
+	return key[:len(key)-padLen], nil
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	key, cert := testCert(t, "Example Service")
+	_, caCert := testCert(t, "Example CA")
+	entries := []keystoreEntry{
+		{alias: "service", key: key, chain: []*x509.Certificate{cert, caCert}},
+		{alias: "example-ca", chain: []*x509.Certificate{caCert}},
+	}
+
+	data, err := encodePKCS12(entries, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bags, err := readPKCS12(data, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cert bags come first, followed by the key bags.
+	if len(bags) != 4 {
+		t.Fatalf("expected 4 bags, got %d", len(bags))
+	}
+	keyID := sha1.Sum(cert.Raw)
+
+	for i, expected := range []*x509.Certificate{cert, caCert, caCert} {
+		c, err := bagCert(bags[i])
+		if err != nil {
+			t.Fatalf("bag %d: %s", i, err)
+		}
+		if !c.Equal(expected) {
+			t.Errorf("bag %d: cert does not round-trip", i)
+		}
+	}
+	if bags[0].friendlyName != "service" || !bytes.Equal(bags[0].localKeyID, keyID[:]) || bags[0].trustedUsage {
+		t.Error("expected the service cert to be named service and tied to its key")
+	}
+	if bags[1].friendlyName != "" || bags[1].localKeyID != nil || bags[1].trustedUsage {
+		t.Error("expected the chain cert to have no attributes")
+	}
+	if bags[2].friendlyName != "example-ca" || bags[2].localKeyID != nil || !bags[2].trustedUsage {
+		t.Error("expected the CA cert to be a trusted cert named example-ca")
+	}
+
+	decrypted, err := decryptPKCS12Key(bags[3], "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, key) {
+		t.Error("private key does not round-trip")
+	}
+	if bags[3].friendlyName != "service" || !bytes.Equal(bags[3].localKeyID, keyID[:]) {
+		t.Error("expected the key to be named service and tied to its cert")
+	}
+}
+
+func TestEncodePKCS12Integrity(t *testing.T) {
+	key, cert := testCert(t, "Example Service")
+	data, err := encodePKCS12([]keystoreEntry{{alias: "service", key: key, chain: []*x509.Certificate{cert}}}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = readPKCS12(data, "wrong"); err == nil {
+		t.Error("expected the MAC check to fail with the wrong password")
+	}
+
+	var pfx pfxPdu
+	if err = unmarshalAll(data, &pfx); err != nil {
+		t.Fatal(err)
+	}
+	authSafeContents, err := dataContent(pfx.AuthSafe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := bytes.Index(data, authSafeContents)
+	if offset < 0 {
+		t.Fatal("authenticated safe not found in the keystore")
+	}
+	tampered := append([]byte{}, data...)
+	tampered[offset+len(authSafeContents)/2] ^= 0xff
+	if _, err = readPKCS12(tampered, "s3cret"); err == nil {
+		t.Error("expected the MAC check to fail for a modified keystore")
+	}
+}
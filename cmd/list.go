@@ -0,0 +1,13 @@
+package cmd
+
+import "github.com/spf13/cobra"
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the Vault resources represented by the subcommands.",
+	Long:  `Lists the Vault resources represented by the subcommands.`,
+}
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+}
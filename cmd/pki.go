@@ -0,0 +1,495 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// parseCertPEM decodes the first PEM-encoded certificate found in contents.
+func parseCertPEM(contents string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(contents))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("expected a CERTIFICATE PEM block, found %s", block.Type)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parseCertsPEM decodes all of the PEM-encoded certificates in contents.
+func parseCertsPEM(contents string) ([]*x509.Certificate, error) {
+	var (
+		certs []*x509.Certificate
+		block *pem.Block
+	)
+	rest := []byte(contents)
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// certSANs returns the DNS and IP subject alternative names in the cert.
+func certSANs(c *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+// formatName formats a subject or issuer name for display, e.g.
+// "CN=example.org,O=CyVerse".
+func formatName(n pkix.Name) string {
+	var parts []string
+	if n.CommonName != "" {
+		parts = append(parts, "CN="+n.CommonName)
+	}
+	for _, ou := range n.OrganizationalUnit {
+		parts = append(parts, "OU="+ou)
+	}
+	for _, o := range n.Organization {
+		parts = append(parts, "O="+o)
+	}
+	for _, l := range n.Locality {
+		parts = append(parts, "L="+l)
+	}
+	for _, st := range n.Province {
+		parts = append(parts, "ST="+st)
+	}
+	for _, c := range n.Country {
+		parts = append(parts, "C="+c)
+	}
+	return strings.Join(parts, ",")
+}
+
+// fingerprint returns the SHA-256 fingerprint of the cert as colon-separated
+// pairs of uppercase hex digits, the same format that openssl uses.
+func fingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+// verifyAgainst returns an error if the cert doesn't chain up to one of the
+// trusted CA certs, possibly through the intermediate CA certs.
+func verifyAgainst(c *x509.Certificate, trusted []*x509.Certificate, intermediates ...*x509.Certificate) error {
+	roots := x509.NewCertPool()
+	for _, t := range trusted {
+		roots.AddCert(t)
+	}
+	pool := x509.NewCertPool()
+	for _, i := range intermediates {
+		pool.AddCert(i)
+	}
+	_, err := c.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: pool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// daysRemaining returns the number of whole days until the cert expires.
+func daysRemaining(c *x509.Certificate) int {
+	return int(time.Until(c.NotAfter).Hours() / 24)
+}
+
+// dataStrings converts a list-valued field returned by Vault into a []string.
+// Older versions of Vault return some lists as comma-separated strings, so
+// those are handled as well.
+func dataStrings(v interface{}) []string {
+	var retval []string
+	switch t := v.(type) {
+	case string:
+		for _, s := range strings.Split(t, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				retval = append(retval, s)
+			}
+		}
+	case []interface{}:
+		for _, s := range t {
+			if str, ok := s.(string); ok && str != "" {
+				retval = append(retval, str)
+			}
+		}
+	case []string:
+		retval = append(retval, t...)
+	}
+	return retval
+}
+
+// containsString returns true if the value is one of the values.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// dataBool converts a boolean field returned by Vault into a bool.
+func dataBool(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case string:
+		return t == "true"
+	}
+	return false
+}
+
+// dataDuration converts a TTL field returned by Vault into a time.Duration.
+// Vault returns TTLs either as a number of seconds or as a duration string
+// depending on the version and endpoint.
+func dataDuration(v interface{}) (time.Duration, error) {
+	switch t := v.(type) {
+	case json.Number:
+		secs, err := t.Int64()
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(secs) * time.Second, nil
+	case float64:
+		return time.Duration(t) * time.Second, nil
+	case int:
+		return time.Duration(t) * time.Second, nil
+	case string:
+		if t == "" || t == "0" {
+			return 0, nil
+		}
+		return parseTTL(t)
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unexpected TTL value %v", v)
+}
+
+// nameAllowed returns true if the role settings permit a cert for the given
+// DNS name. This mirrors the checks performed by the Vault PKI backend.
+func nameAllowed(role map[string]interface{}, name string) bool {
+	if dataBool(role["allow_any_name"]) {
+		return true
+	}
+	if name == "localhost" && dataBool(role["allow_localhost"]) {
+		return true
+	}
+	for _, d := range dataStrings(role["allowed_domains"]) {
+		if name == d && dataBool(role["allow_bare_domains"]) {
+			return true
+		}
+		if dataBool(role["allow_subdomains"]) && strings.HasSuffix(name, "."+d) {
+			return true
+		}
+		if dataBool(role["allow_glob_domains"]) {
+			if matched, _ := path.Match(d, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkNamesAllowed returns an error if the role settings would cause Vault
+// to reject any of the requested names or IP SANs.
+func checkNamesAllowed(role map[string]interface{}, names, ips []string) error {
+	var denied []string
+	for _, n := range names {
+		if !nameAllowed(role, n) {
+			denied = append(denied, n)
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("names not allowed by the role: %s", strings.Join(denied, ", "))
+	}
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("%s is not a valid IP address", ip)
+		}
+	}
+	if v, ok := role["allow_ip_sans"]; ok && len(ips) > 0 && !dataBool(v) {
+		return errors.New("IP SANs are not allowed by the role")
+	}
+	return nil
+}
+
+// usageFlags maps the values of --usage to the server_flag and client_flag
+// settings that a role needs for issuing certs with that usage.
+var usageFlags = map[string][2]bool{
+	"server": {true, false},
+	"client": {false, true},
+	"both":   {true, true},
+}
+
+// usageEKUs maps the values of --usage to the extended key usages that certs
+// with that usage need.
+var usageEKUs = map[string][]x509.ExtKeyUsage{
+	"server": {x509.ExtKeyUsageServerAuth},
+	"client": {x509.ExtKeyUsageClientAuth},
+	"both":   {x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+}
+
+// checkRoleUsage returns an error if the role settings don't match the usage.
+// An empty usage matches every role.
+func checkRoleUsage(role map[string]interface{}, usage string) error {
+	if usage == "" {
+		return nil
+	}
+	flags, ok := usageFlags[usage]
+	if !ok {
+		return fmt.Errorf("unsupported usage %s", usage)
+	}
+	server, client := dataBool(role["server_flag"]), dataBool(role["client_flag"])
+	if server != flags[0] || client != flags[1] {
+		return fmt.Errorf(
+			"the role has server_flag=%t and client_flag=%t, but usage %s needs server_flag=%t and client_flag=%t",
+			server,
+			client,
+			usage,
+			flags[0],
+			flags[1],
+		)
+	}
+	return nil
+}
+
+// extKeyUsageNames contains the names that Vault uses for extended key usages.
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "ServerAuth",
+	x509.ExtKeyUsageClientAuth:      "ClientAuth",
+	x509.ExtKeyUsageCodeSigning:     "CodeSigning",
+	x509.ExtKeyUsageEmailProtection: "EmailProtection",
+	x509.ExtKeyUsageTimeStamping:    "TimeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+// certEKUs returns the names of the extended key usages in the cert. Usages
+// without a name are returned as OIDs.
+func certEKUs(c *x509.Certificate) []string {
+	var ekus []string
+	for _, u := range c.ExtKeyUsage {
+		if name, ok := extKeyUsageNames[u]; ok {
+			ekus = append(ekus, name)
+		} else {
+			ekus = append(ekus, fmt.Sprintf("unknown (%d)", u))
+		}
+	}
+	for _, oid := range c.UnknownExtKeyUsage {
+		ekus = append(ekus, oid.String())
+	}
+	return ekus
+}
+
+// missingEKUs returns the names of the extended key usages needed for the
+// usage that the cert doesn't have.
+func missingEKUs(c *x509.Certificate, usage string) []string {
+	var missing []string
+	for _, needed := range usageEKUs[usage] {
+		found := false
+		for _, u := range c.ExtKeyUsage {
+			found = found || u == needed || u == x509.ExtKeyUsageAny
+		}
+		if !found {
+			missing = append(missing, extKeyUsageNames[needed])
+		}
+	}
+	return missing
+}
+
+// certUsage returns the value of --usage that matches the extended key usages
+// of the cert, or an empty string if it has neither of them.
+func certUsage(c *x509.Certificate) string {
+	var server, client bool
+	for _, u := range c.ExtKeyUsage {
+		server = server || u == x509.ExtKeyUsageServerAuth || u == x509.ExtKeyUsageAny
+		client = client || u == x509.ExtKeyUsageClientAuth || u == x509.ExtKeyUsageAny
+	}
+	for usage, flags := range usageFlags {
+		if flags[0] == server && flags[1] == client {
+			return usage
+		}
+	}
+	return ""
+}
+
+// encodeCertPEM returns the PEM encoding of the cert.
+func encodeCertPEM(c *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+}
+
+// formatSerial formats a cert serial number the way Vault does, as
+// colon-separated pairs of hex digits.
+func formatSerial(serial *big.Int) string {
+	var parts []string
+	for _, b := range serial.Bytes() {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+// mountFromCert determines the PKI backend that issued the cert from its CRL
+// distribution points or issuing certificate URLs, which are set up by
+// 'init intermediate-ca' to point at /v1/<mount>/crl and /v1/<mount>/ca.
+func mountFromCert(c *x509.Certificate) (string, error) {
+	var urls []string
+	urls = append(urls, c.CRLDistributionPoints...)
+	urls = append(urls, c.IssuingCertificateURL...)
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		p := strings.TrimPrefix(parsed.Path, "/v1/")
+		if p == parsed.Path {
+			continue
+		}
+		for _, suffix := range []string{"/crl", "/ca"} {
+			if strings.HasSuffix(p, suffix) {
+				return strings.TrimSuffix(p, suffix), nil
+			}
+		}
+	}
+	return "", errors.New("could not determine the mount from the cert")
+}
+
+// findRole returns the only role in the mount that allows the given names and
+// IP SANs and, unless usage is empty, issues certs for the usage. Returns an
+// error if no role or more than one role matches.
+func findRole(mount string, names, ips []string, usage string) (string, error) {
+	roles, err := listRoles(mount)
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, role := range roles {
+		roleSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", mount, role))
+		if err != nil {
+			return "", err
+		}
+		if roleSecret == nil || roleSecret.Data == nil {
+			continue
+		}
+		if checkNamesAllowed(roleSecret.Data, names, ips) == nil && checkRoleUsage(roleSecret.Data, usage) == nil {
+			matches = append(matches, role)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no role in %s allows the names in the cert", mount)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("multiple roles in %s allow the names in the cert: %s", mount, strings.Join(matches, ", "))
+}
+
+// certChainPEM returns the cert followed by the issuing CA from the response
+// to an issue or sign request.
+func certChainPEM(certSecret *vault.Secret) []byte {
+	return []byte(fmt.Sprintf(
+		"%s\n%s\n",
+		certSecret.Data["certificate"].(string),
+		certSecret.Data["issuing_ca"].(string),
+	))
+}
+
+// checkIssuedCert returns an error if the response to an issue or sign request
+// is missing fields.
+func checkIssuedCert(certSecret *vault.Secret) error {
+	if certSecret == nil || certSecret.Data == nil {
+		return errors.New("no data returned")
+	}
+	if _, ok := certSecret.Data["certificate"].(string); !ok {
+		return errors.New("no certificate found")
+	}
+	if _, ok := certSecret.Data["issuing_ca"].(string); !ok {
+		return errors.New("no issuing CA found")
+	}
+	if _, ok := certSecret.Data["serial_number"].(string); !ok {
+		return errors.New("no serial number found")
+	}
+	return nil
+}
+
+// listRoles returns the names of the roles in the given mount.
+func listRoles(mount string) ([]string, error) {
+	listSecret, err := vaultAPI.Client().Logical().List(fmt.Sprintf("%s/roles", mount))
+	if err != nil {
+		return nil, err
+	}
+	if listSecret == nil || listSecret.Data == nil {
+		return nil, nil
+	}
+	return dataStrings(listSecret.Data["keys"]), nil
+}
+
+// copyRoles copies every role in the from mount into the to mount, returning
+// the longest max TTL of the copied roles. A returned max TTL of 0 means that
+// at least one role defers to the mount's max lease TTL.
+func copyRoles(from, to string) (time.Duration, error) {
+	roles, err := listRoles(from)
+	if err != nil {
+		return 0, err
+	}
+	var longest time.Duration
+	unbounded := false
+	for _, role := range roles {
+		roleSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", from, role))
+		if err != nil {
+			return 0, err
+		}
+		if roleSecret == nil || roleSecret.Data == nil {
+			continue
+		}
+		if _, err = vaultAPI.Write(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", to, role), roleSecret.Data); err != nil {
+			return 0, err
+		}
+		maxTTL, err := dataDuration(roleSecret.Data["max_ttl"])
+		if err != nil {
+			return 0, err
+		}
+		if maxTTL == 0 {
+			unbounded = true
+		}
+		if maxTTL > longest {
+			longest = maxTTL
+		}
+	}
+	if unbounded {
+		return 0, nil
+	}
+	return longest, nil
+}
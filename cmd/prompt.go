@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// stdin is shared by every prompt. A reader per prompt would buffer past the
+// answer it reads, losing the answers to later prompts when they're piped in.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm prints the prompt and returns true if the user answers yes.
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N]: ", prompt)
+	answer, err := stdin.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// confirmTyped prints the prompt and returns true if the user answers with the
+// expected text.
+func confirmTyped(prompt, expected string) bool {
+	fmt.Printf("%s: ", prompt)
+	answer, err := stdin.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(answer) == expected
+}
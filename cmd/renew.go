@@ -0,0 +1,13 @@
+package cmd
+
+import "github.com/spf13/cobra"
+
+var renewCmd = &cobra.Command{
+	Use:   "renew",
+	Short: "Renews the Vault resources represented by the subcommands.",
+	Long:  `Renews the Vault resources represented by the subcommands.`,
+}
+
+func init() {
+	RootCmd.AddCommand(renewCmd)
+}
@@ -0,0 +1,470 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// The kinds of role fields, which determine how the values returned by Vault
+// are compared against the desired values.
+const (
+	roleFieldString = iota
+	roleFieldBool
+	roleFieldList
+	roleFieldTTL
+)
+
+// defaultKeyUsage is the key usage that Vault gives roles by default.
+var defaultKeyUsage = []string{"DigitalSignature", "KeyAgreement", "KeyEncipherment"}
+
+// roleField is a single setting of a PKI role.
+type roleField struct {
+	name  string
+	kind  int
+	value interface{}
+}
+
+// Role contains the commands for managing the roles that TLS certs are issued
+// with.
+type Role struct {
+	mount            string
+	role             string
+	allowedDomains   []string
+	allowSubdomains  bool
+	allowBareDomains bool
+	allowGlobDomains bool
+	allowAnyName     bool
+	allowLocalhost   bool
+	allowIPSANs      bool
+	enforceHostnames bool
+	serverFlag       bool
+	clientFlag       bool
+	keyUsage         []string
+	extKeyUsage      []string
+	keys             keySettings
+	maxTTL           string
+	ttl              string
+	yes              bool
+	Init             *cobra.Command
+	Check            *cobra.Command
+	List             *cobra.Command
+	Remove           *cobra.Command
+}
+
+// NewRole returns a newly instantiated *Role.
+func NewRole() *Role {
+	r := &Role{
+		Init: &cobra.Command{
+			Use:         "role",
+			Short:       "Creates or updates a role for issuing TLS certs.",
+			Annotations: map[string]string{dryRunAnnotation: "true", destructiveAnnotation: "true"},
+			Long: `Creates or updates the role named --role in the PKI backend at --mount
+with the settings given by the rest of the flags. Every setting of the role is
+written, so settings that aren't set on the command-line are reset to the
+defaults of the flags.`,
+		},
+		Check: &cobra.Command{
+			Use:   "role",
+			Short: "Compares a role against the desired settings.",
+			Long: `Reads the role named --role in the PKI backend at --mount and compares
+each of its settings against the settings given by the rest of the flags,
+using the same defaults as 'init role'.`,
+		},
+		List: &cobra.Command{
+			Use:   "roles",
+			Short: "Lists the roles in a PKI backend.",
+			Long: `Lists the roles in the PKI backend at --mount along with the names they
+allow, their flags, key settings, and max TTLs.`,
+		},
+		Remove: &cobra.Command{
+			Use:         "role",
+			Short:       "Removes a role.",
+			Annotations: map[string]string{dryRunAnnotation: "true", destructiveAnnotation: "true"},
+			Long: `Removes the role named --role from the PKI backend at --mount. Certs that
+were issued with the role remain valid. Asks for confirmation unless --yes is
+set.`,
+		},
+	}
+
+	r.Init.Run = r.initRun
+	r.Check.Run = r.checkRun
+	r.List.Run = r.listRun
+	r.Remove.Run = r.removeRun
+
+	for _, c := range []*cobra.Command{r.Init, r.Check, r.List, r.Remove} {
+		c.PersistentFlags().StringVar(
+			&r.mount,
+			"mount",
+			defaultIntMount,
+			"The path in Vault to the intermediate CA backend.",
+		)
+	}
+	for _, c := range []*cobra.Command{r.Init, r.Check, r.Remove} {
+		c.PersistentFlags().StringVar(
+			&r.role,
+			"role",
+			"",
+			"The name of the role.",
+		)
+	}
+	for _, c := range []*cobra.Command{r.Init, r.Check} {
+		r.addSettingsFlags(c)
+	}
+	r.Remove.PersistentFlags().BoolVar(
+		&r.yes,
+		"yes",
+		false,
+		"Do not ask for confirmation before removing the role.",
+	)
+
+	return r
+}
+
+// addSettingsFlags registers the flags for the role's settings with the
+// command.
+func (r *Role) addSettingsFlags(c *cobra.Command) {
+	c.PersistentFlags().StringSliceVar(
+		&r.allowedDomains,
+		"allowed-domain",
+		[]string{},
+		"A domain that certs may be issued for. May be repeated.",
+	)
+	c.PersistentFlags().BoolVar(
+		&r.allowSubdomains,
+		"allow-subdomains",
+		false,
+		"Allow certs for subdomains of the allowed domains.",
+	)
+	c.PersistentFlags().BoolVar(
+		&r.allowBareDomains,
+		"allow-bare-domains",
+		false,
+		"Allow certs for the allowed domains themselves.",
+	)
+	c.PersistentFlags().BoolVar(
+		&r.allowGlobDomains,
+		"allow-glob-domains",
+		false,
+		"Treat the allowed domains as glob patterns.",
+	)
+	c.PersistentFlags().BoolVar(
+		&r.allowAnyName,
+		"allow-any-name",
+		false,
+		"Allow certs for any name, ignoring the allowed domains.",
+	)
+	c.PersistentFlags().BoolVar(
+		&r.allowLocalhost,
+		"allow-localhost",
+		true,
+		"Allow certs for localhost.",
+	)
+	c.PersistentFlags().BoolVar(
+		&r.allowIPSANs,
+		"allow-ip-sans",
+		true,
+		"Allow IP subject alternative names.",
+	)
+	c.PersistentFlags().BoolVar(
+		&r.enforceHostnames,
+		"enforce-hostnames",
+		true,
+		"Only allow valid hostnames as names.",
+	)
+	c.PersistentFlags().BoolVar(
+		&r.serverFlag,
+		"server-flag",
+		true,
+		"Mark issued certs for use by servers.",
+	)
+	c.PersistentFlags().BoolVar(
+		&r.clientFlag,
+		"client-flag",
+		true,
+		"Mark issued certs for use by clients.",
+	)
+	c.PersistentFlags().StringSliceVar(
+		&r.keyUsage,
+		"key-usage",
+		defaultKeyUsage,
+		"A key usage to set in issued certs, e.g. DigitalSignature. May be repeated.",
+	)
+	c.PersistentFlags().StringSliceVar(
+		&r.extKeyUsage,
+		"ext-key-usage",
+		[]string{},
+		"An extended key usage to set in issued certs in addition to the ones from --server-flag and --client-flag, e.g. CodeSigning. May be repeated.",
+	)
+	r.keys.addFlags(c.PersistentFlags())
+	c.PersistentFlags().StringVar(
+		&r.maxTTL,
+		"max-ttl",
+		defaultRoleMaxTTL,
+		"The max TTL of certs issued with the role.",
+	)
+	c.PersistentFlags().StringVar(
+		&r.ttl,
+		"ttl",
+		"",
+		"The default TTL of certs issued with the role. Defaults to the mount's default lease TTL if not set.",
+	)
+}
+
+// validate returns an error if the key settings or TTLs for the role are not
+// usable.
+func (r *Role) validate() error {
+	if err := r.keys.validate(); err != nil {
+		return err
+	}
+	ttls := map[string]string{"--max-ttl": r.maxTTL}
+	if r.ttl != "" {
+		ttls["--ttl"] = r.ttl
+	}
+	parsed, err := parseTTLs(ttls)
+	if err != nil {
+		return err
+	}
+	if parsed["--max-ttl"] == 0 {
+		return nil
+	}
+	return checkTTL("--ttl", parsed["--ttl"], "--max-ttl", parsed["--max-ttl"])
+}
+
+// fields returns the desired settings of the role in the order that they're
+// reported in.
+func (r *Role) fields() []roleField {
+	return []roleField{
+		{"allowed_domains", roleFieldList, r.allowedDomains},
+		{"allow_subdomains", roleFieldBool, r.allowSubdomains},
+		{"allow_bare_domains", roleFieldBool, r.allowBareDomains},
+		{"allow_glob_domains", roleFieldBool, r.allowGlobDomains},
+		{"allow_any_name", roleFieldBool, r.allowAnyName},
+		{"allow_localhost", roleFieldBool, r.allowLocalhost},
+		{"allow_ip_sans", roleFieldBool, r.allowIPSANs},
+		{"enforce_hostnames", roleFieldBool, r.enforceHostnames},
+		{"server_flag", roleFieldBool, r.serverFlag},
+		{"client_flag", roleFieldBool, r.clientFlag},
+		{"key_usage", roleFieldList, r.keyUsage},
+		{"ext_key_usage", roleFieldList, r.extKeyUsage},
+		{"key_type", roleFieldString, r.keys.keyType},
+		{"key_bits", roleFieldString, r.keys.keyBits},
+		{"max_ttl", roleFieldTTL, r.maxTTL},
+		{"ttl", roleFieldTTL, r.ttl},
+	}
+}
+
+// formatRoleValue normalizes a role setting, either desired or returned by
+// Vault, into a string so that the two can be compared.
+func formatRoleValue(kind int, v interface{}) string {
+	switch kind {
+	case roleFieldBool:
+		return strconv.FormatBool(dataBool(v))
+	case roleFieldList:
+		values := dataStrings(v)
+		sort.Strings(values)
+		return strings.Join(values, ",")
+	case roleFieldTTL:
+		d, err := dataDuration(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return d.String()
+	}
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// differences returns the names of the fields whose values in the role's data
+// read from Vault don't match the desired settings.
+func (r *Role) differences(data map[string]interface{}) []string {
+	var diffs []string
+	for _, f := range r.fields() {
+		if formatRoleValue(f.kind, f.value) != formatRoleValue(f.kind, data[f.name]) {
+			diffs = append(diffs, f.name)
+		}
+	}
+	return diffs
+}
+
+// write creates or replaces the role with the desired settings.
+func (r *Role) write() error {
+	data := map[string]interface{}{}
+	for _, f := range r.fields() {
+		if f.name == "ttl" && r.ttl == "" {
+			continue
+		}
+		data[f.name] = f.value
+	}
+	_, err := vaultAPI.Write(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", r.mount, r.role), data)
+	return err
+}
+
+func (r *Role) initRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, r.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.mount = mount
+	if r.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+	if r.role == "" {
+		log.Fatal("--role must be set.")
+	}
+	if err := r.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Writing the role:\t")
+	if err := r.write(); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+	w.Flush()
+}
+
+func (r *Role) checkRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, r.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.mount = mount
+	if r.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+	if r.role == "" {
+		log.Fatal("--role must be set.")
+	}
+	if err := r.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Role exists:\t")
+	roleSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", r.mount, r.role))
+	if err != nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+		FatalFlush(w, err)
+	}
+	if roleSecret == nil || roleSecret.Data == nil {
+		fmt.Fprint(w, "NO\t\n")
+		w.Flush()
+		return
+	}
+	fmt.Fprint(w, "YES\t\n")
+
+	matches := true
+	fmt.Fprint(w, "\nFIELD\tDESIRED\tACTUAL\tMATCHES\t\n")
+	for _, f := range r.fields() {
+		desired := formatRoleValue(f.kind, f.value)
+		actual := formatRoleValue(f.kind, roleSecret.Data[f.name])
+		result := "YES"
+		if desired != actual {
+			result = "NO"
+			matches = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", f.name, desired, actual, result)
+	}
+
+	fmt.Fprint(w, "\nRole matches the desired settings:\t")
+	if matches {
+		fmt.Fprint(w, "YES\t\n")
+	} else {
+		fmt.Fprint(w, "NO\t\n")
+	}
+	w.Flush()
+}
+
+func (r *Role) listRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, r.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.mount = mount
+	if r.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+
+	roles, err := listRoles(r.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(roles)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	fmt.Fprint(w, "ROLE\tALLOWED NAMES\tSERVER\tCLIENT\tKEY\tMAX TTL\t\n")
+	for _, role := range roles {
+		roleSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", r.mount, role))
+		if err != nil {
+			FatalFlush(w, err)
+		}
+		if roleSecret == nil || roleSecret.Data == nil {
+			continue
+		}
+		data := roleSecret.Data
+
+		allowed := strings.Join(dataStrings(data["allowed_domains"]), ", ")
+		if dataBool(data["allow_any_name"]) {
+			allowed = "any"
+		}
+		maxTTL := formatRoleValue(roleFieldTTL, data["max_ttl"])
+		if maxTTL == "0s" {
+			maxTTL = "mount default"
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s %s\t%s\t\n",
+			role,
+			allowed,
+			formatRoleValue(roleFieldBool, data["server_flag"]),
+			formatRoleValue(roleFieldBool, data["client_flag"]),
+			formatRoleValue(roleFieldString, data["key_type"]),
+			formatRoleValue(roleFieldString, data["key_bits"]),
+			maxTTL,
+		)
+	}
+	w.Flush()
+}
+
+func (r *Role) removeRun(cmd *cobra.Command, args []string) {
+	if r.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+	if r.role == "" {
+		log.Fatal("--role must be set.")
+	}
+	if !r.yes && !dryRun && !confirm(fmt.Sprintf("Remove role %s from %s?", r.role, r.mount)) {
+		log.Fatal("removal cancelled")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Removing the role:\t")
+	if _, err := vaultAPI.Delete(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", r.mount, r.role)); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+	w.Flush()
+}
+
+func init() {
+	r := NewRole()
+	initCmd.AddCommand(r.Init)
+	checkCmd.AddCommand(r.Check)
+	listCmd.AddCommand(r.List)
+	removeCmd.AddCommand(r.Remove)
+}
@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/cyverse-de/vaulter"
 	vault "github.com/hashicorp/vault/api"
@@ -14,20 +18,24 @@ import (
 
 // RootCA contains the commands associated with the root CA.
 type RootCA struct {
-	mount      string
-	role       string
-	commonName string
-	Init       *cobra.Command
-	Check      *cobra.Command
-	Remove     *cobra.Command
+	mount       string
+	role        string
+	commonName  string
+	keys        keySettings
+	mountMaxTTL string
+	ttl         string
+	Init        *cobra.Command
+	Check       *cobra.Command
+	Remove      *cobra.Command
 }
 
 // NewRootCA returns a newly instantiated *RootCA.
 func NewRootCA() *RootCA {
 	r := &RootCA{
 		Init: &cobra.Command{
-			Use:   "root-ca",
-			Short: "Initialize a root CA in Vault",
+			Use:         "root-ca",
+			Short:       "Initialize a root CA in Vault",
+			Annotations: map[string]string{dryRunAnnotation: "true"},
 			Long: `Initializes a root CA in Vault, creating a backend mount, a role,
 and a root cert. Requires the --common-name setting. Does not recreate something
 if it already exists. If you require a full reset of the mount, role, and/or
@@ -41,12 +49,17 @@ following:
 	1. If the appropriate backend is mounted.
 	2. If the role exists.
 	3. If the root certificate exists.
-This command does not create any of the above if it does not exist. Use the
-'init root-ca' command if that is what you require.`,
+	4. If the root certificate is self-signed and matches the requested
+	   common name, key type and size, and TTL.
+	5. When the root certificate expires.
+The root certificate is only read from the backend, so this command is safe to
+run as often as needed. It does not create any of the above if it does not
+exist. Use the 'init root-ca' command if that is what you require.`,
 		},
 		Remove: &cobra.Command{
-			Use:   "root-ca",
-			Short: "Removes the root CA from Vault",
+			Use:         "root-ca",
+			Short:       "Removes the root CA from Vault",
+			Annotations: map[string]string{dryRunAnnotation: "true", destructiveAnnotation: "true"},
 			Long: `Removes the root CA, the role used with the root CA, and the root
 cert from Vault. This is done by unmounting the Vault backend for the root CA.
 This command will return successfully if the root CA backend is already
@@ -76,6 +89,19 @@ unmounted.`,
 		"",
 		"The common name to use for operations on the intermediate CA.",
 	)
+	r.keys.addFlags(r.Init.PersistentFlags())
+	r.Init.PersistentFlags().StringVar(
+		&r.mountMaxTTL,
+		"mount-max-ttl",
+		defaultRootMountMaxTTL,
+		"The max lease TTL for the root CA pki backend.",
+	)
+	r.Init.PersistentFlags().StringVar(
+		&r.ttl,
+		"ttl",
+		defaultRootTTL,
+		"The TTL of the root CA cert. Must not exceed --mount-max-ttl.",
+	)
 
 	r.Check.PersistentFlags().StringVar(
 		&r.mount, // defined in root.go
@@ -95,6 +121,13 @@ unmounted.`,
 		"",
 		"The common name to use for operations on the intermediate CA.",
 	)
+	r.keys.addFlags(r.Check.PersistentFlags())
+	r.Check.PersistentFlags().StringVar(
+		&r.ttl,
+		"ttl",
+		defaultRootTTL,
+		"The expected TTL of the root CA cert.",
+	)
 
 	r.Remove.PersistentFlags().StringVar(
 		&r.mount, // defined in root.go
@@ -106,6 +139,36 @@ unmounted.`,
 	return r
 }
 
+// rootCertDifferences returns a description of each way in which the root CA
+// cert differs from a self-signed cert with the requested common name, key
+// settings, and TTL.
+func rootCertDifferences(c *x509.Certificate, chain []*x509.Certificate, commonName string, keys *keySettings, ttl time.Duration) []string {
+	var diffs []string
+	if c.Subject.CommonName != commonName {
+		diffs = append(diffs, fmt.Sprintf("common name is %s, not %s", c.Subject.CommonName, commonName))
+	}
+	if actual := certKeySettings(c); actual.String() != keys.String() {
+		diffs = append(diffs, fmt.Sprintf("key is %s, not %s", actual, keys))
+	}
+
+	// Vault backdates certs and caps their TTL at the mount's max lease TTL,
+	// so small differences in the lifetime don't count.
+	lifetime := c.NotAfter.Sub(c.NotBefore)
+	if diff := lifetime - ttl; diff > time.Hour || diff < -time.Hour {
+		diffs = append(diffs, fmt.Sprintf("lifetime is %s, not %s", lifetime-lifetime%time.Hour, ttl))
+	}
+
+	if c.CheckSignatureFrom(c) != nil {
+		diffs = append(diffs, "cert is not self-signed")
+	}
+	for _, chained := range chain {
+		if !bytes.Equal(chained.Raw, c.Raw) {
+			diffs = append(diffs, fmt.Sprintf("mount has a CA chain including %s", formatName(chained.Subject)))
+		}
+	}
+	return diffs
+}
+
 func (r *RootCA) initRun(cmd *cobra.Command, args []string) {
 	if r.mount == "" {
 		log.Fatal("--mount must be set.")
@@ -119,8 +182,32 @@ func (r *RootCA) initRun(cmd *cobra.Command, args []string) {
 		log.Fatal("--common-name must be set.")
 	}
 
+	if err := r.keys.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	ttls, err := parseTTLs(map[string]string{
+		"--mount-max-ttl": r.mountMaxTTL,
+		"--ttl":           r.ttl,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = checkTTL("--ttl", ttls["--ttl"], "--mount-max-ttl", ttls["--mount-max-ttl"]); err != nil {
+		log.Fatal(err)
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	r.init(w, ttls["--ttl"])
+	w.Flush()
+}
 
+// init mounts the root CA backend and creates the role and the root cert,
+// skipping whatever already exists. An existing root cert is compared against
+// the requested settings and the TTL, but never replaced. Returns whether the
+// root CA was created, updated, or left unchanged.
+func (r *RootCA) init(w *tabwriter.Writer, ttl time.Duration) string {
+	result := resultUnchanged
 	fmt.Fprint(w, "Mounting root CA backend:\t")
 	hasRoot, err := vaulter.IsMounted(vaultAPI, r.mount)
 	if err != nil {
@@ -130,11 +217,12 @@ func (r *RootCA) initRun(cmd *cobra.Command, args []string) {
 	if !hasRoot {
 		if err = vaulter.Mount(vaultAPI, r.mount, &vaulter.MountConfiguration{
 			Type:        "pki",
-			MaxLeaseTTL: "87600h",
+			MaxLeaseTTL: r.mountMaxTTL,
 		}); err != nil {
 			fmt.Fprintf(w, "FAILURE\t\n")
 			FatalFlush(w, err)
 		}
+		result = resultCreated
 		fmt.Fprint(w, "SUCCESS\t\n")
 	} else {
 		fmt.Fprint(w, "SUCCESS\t\n")
@@ -147,34 +235,37 @@ func (r *RootCA) initRun(cmd *cobra.Command, args []string) {
 		FatalFlush(w, err)
 	}
 	if !hasRole {
-		_, err = vaulter.CreateRole(vaultAPI, r.mount, r.role, &vaulter.RoleConfig{
+		_, err = createRole(vaultAPI, r.mount, r.role, &vaulter.RoleConfig{
 			AllowedDomains:  r.commonName,
 			AllowSubdomains: true,
-			KeyBits:         4096,
+			KeyBits:         r.keys.keyBits,
 			AllowAnyName:    true,
-		})
+		}, r.keys.keyType)
 		if err != nil {
 			fmt.Fprintf(w, "FAILURE\t\n")
 			FatalFlush(w, err)
 		}
+		if result == resultUnchanged {
+			result = resultUpdated
+		}
 		fmt.Fprintf(w, "SUCCESS\t\n")
 	} else {
 		fmt.Fprintf(w, "SUCCESS\t\n")
 	}
 
 	fmt.Fprint(w, "Creating root CA cert:\t")
-	var hasCert bool
-	if hasCert, err = vaulter.HasRootCert(vaultAPI, r.mount, r.role, r.commonName); err != nil {
+	caCert, err := readCACert(vaultAPI, r.mount)
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
-	if !hasCert {
+	if caCert == nil {
 		var rootCertSecret *vault.Secret
-		rootCertSecret, err = vaulter.RootCACert(vaultAPI, r.mount, &vaulter.RootCACertConfig{
+		rootCertSecret, err = rootCACert(vaultAPI, r.mount, &vaulter.RootCACertConfig{
 			CommonName: r.commonName,
-			TTL:        "87600h",
-			KeyBits:    4096,
-		})
+			TTL:        r.ttl,
+			KeyBits:    r.keys.keyBits,
+		}, r.keys.keyType)
 		if err != nil {
 			fmt.Fprint(w, "FAILURE\t\n")
 			FatalFlush(w, err)
@@ -183,11 +274,24 @@ func (r *RootCA) initRun(cmd *cobra.Command, args []string) {
 			fmt.Fprint(w, "FAILURE\t\n")
 			FatalFlush(w, errors.New("root CA cert secret is nil"))
 		}
+		if result == resultUnchanged {
+			result = resultUpdated
+		}
 		fmt.Fprint(w, "SUCCESS\t\n")
 	} else {
-		fmt.Fprint(w, "SUCCESS\t\n")
+		chain, err := readImportedChain(r.mount)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		diffs := rootCertDifferences(caCert, chain, r.commonName, &r.keys, ttl)
+		if len(diffs) > 0 {
+			fmt.Fprintf(w, "SUCCESS (WARNING: existing cert differs, %s)\t\n", strings.Join(diffs, "; "))
+		} else {
+			fmt.Fprint(w, "SUCCESS\t\n")
+		}
 	}
-	w.Flush()
+	return result
 }
 
 func (r *RootCA) checkRun(cmd *cobra.Command, args []string) {
@@ -203,6 +307,15 @@ func (r *RootCA) checkRun(cmd *cobra.Command, args []string) {
 		log.Fatal("--common-name must be set.")
 	}
 
+	if err := r.keys.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	ttl, err := parseTTL(r.ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
 
 	fmt.Fprintf(w, "Root CA backend is mounted:\t")
@@ -228,21 +341,49 @@ func (r *RootCA) checkRun(cmd *cobra.Command, args []string) {
 		fmt.Fprint(w, "NO\t\n")
 	}
 
+	var caCert *x509.Certificate
 	fmt.Fprintf(w, "Root CA cert exists:\t")
-	if !hasRole {
+	if !hasRoot {
 		fmt.Fprint(w, "UNKNOWN\t\n")
 	} else {
-		var hasCert bool
-		hasCert, err = vaulter.HasRootCert(vaultAPI, r.mount, r.role, r.commonName)
-		if err != nil {
+		if caCert, err = readCACert(vaultAPI, r.mount); err != nil {
 			FatalFlush(w, err)
 		}
-		if hasCert {
+		if caCert != nil {
 			fmt.Fprint(w, "YES\t\n")
 		} else {
 			fmt.Fprint(w, "NO\t\n")
 		}
 	}
+
+	fmt.Fprint(w, "Root CA cert matches the requested settings:\t")
+	if caCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		chain, err := readImportedChain(r.mount)
+		if err != nil {
+			FatalFlush(w, err)
+		}
+		if diffs := rootCertDifferences(caCert, chain, r.commonName, &r.keys, ttl); len(diffs) > 0 {
+			fmt.Fprintf(w, "NO (%s)\t\n", strings.Join(diffs, "; "))
+		} else {
+			fmt.Fprint(w, "YES\t\n")
+		}
+	}
+
+	fmt.Fprint(w, "Root CA key:\t")
+	if caCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		fmt.Fprintf(w, "%s\t\n", certKeySettings(caCert))
+	}
+
+	fmt.Fprint(w, "Root CA cert expires:\t")
+	if caCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		fmt.Fprintf(w, "%s (%d days remaining)\t\n", caCert.NotAfter.Format(time.RFC3339), daysRemaining(caCert))
+	}
 	w.Flush()
 }
 
@@ -3,6 +3,7 @@ package cmd
 import (
 	"log"
 	"net/url"
+	"os"
 
 	"github.com/cyverse-de/vaulter"
 	"github.com/spf13/cobra"
@@ -11,12 +12,26 @@ import (
 var (
 	parentToken string
 	vaultURL    string
+	caCert      string
 	clientCert  string
 	clientKey   string
-	vaultAPI    *vaulter.VaultAPI
+	dryRun      bool
+	vaultAPI    vaultClient
 	vaultCFG    *vaulter.VaultAPIConfig
 )
 
+// vaultClient is the part of the Vault API that de-vault uses. It's satisfied
+// by *vaulter.VaultAPI, and by *recorder for dry runs.
+type vaultClient interface {
+	vaulter.ClientGetter
+	vaulter.Mounter
+	vaulter.Unmounter
+	vaulter.MountLister
+	vaulter.MountReader
+	vaulter.MountWriter
+	vaulter.PathDeleter
+}
+
 const defaultRootRole = "root-ca"
 const defaultRootMount = "root-ca"
 const defaultIntRole = "intermediate-ca"
@@ -38,8 +53,51 @@ var RootCmd = &cobra.Command{
 	Use:   "de-vault",
 	Short: "Utility for managing Vault for the Discovery Environment",
 	Long: `A command-line utility for managing a deployment of Hashicorp's Vault
-project. This tool is geared towards CyVerse's Discovery Environment.`,
+project. This tool is geared towards CyVerse's Discovery Environment.
+
+Flags that aren't passed on the command line are read from the environment, then
+from the file at --config, and then from the active context, before falling back
+to their defaults. The environment variable for a flag is its name prefixed with
+DE_VAULT_, in upper case and with dashes replaced by underscores, e.g.
+DE_VAULT_MOUNT. Prefixing the name with the subcommand, e.g.
+DE_VAULT_GENERATE_TLS_MOUNT, only sets it for that subcommand. The Vault CLI's
+VAULT_ADDR, VAULT_TOKEN, VAULT_CACERT, VAULT_CLIENT_CERT, and VAULT_CLIENT_KEY
+are honored as well, except that the active context's connection settings take
+precedence over them.
+
+The config file may be YAML, TOML, or HCL. Top-level keys apply to every
+subcommand and sections named after a subcommand only apply to it:
+
+  api-url: https://vault.example.org:8200
+  generate:
+    tls:
+      mount: intermediate-ca
+      role: de
+      alt-name: [de.example.org, de-2.example.org]
+
+Contexts hold the Vault API URL, token source, client cert, and mounts of each
+DE deployment and are managed with the 'context' commands. Commands that remove
+or replace things in Vault show the active context before running, and ask for
+its name to be typed if it's protected.`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		err := applyConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if currentContext, err = activeContext(); err != nil {
+			log.Fatal(err)
+		}
+		if currentContext != nil {
+			if err = currentContext.apply(cmd); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if dryRun && cmd.Annotations[dryRunAnnotation] == "" {
+			log.Fatalf("--dry-run is not supported by '%s'.", cmd.CommandPath())
+		}
+
 		if parentToken == "" {
 			log.Fatal("--token must be set.")
 		}
@@ -56,13 +114,32 @@ project. This tool is geared towards CyVerse's Discovery Environment.`,
 			Host:        connURL.Hostname(),
 			Port:        connURL.Port(),
 			Scheme:      connURL.Scheme,
+			CACert:      caCert,
 			ClientCert:  clientCert,
 			ClientKey:   clientKey,
 		}
-		vaultAPI = &vaulter.VaultAPI{}
-		if err = vaulter.InitAPI(vaultAPI, vaultCFG, vaultCFG.ParentToken); err != nil {
+		api := &vaulter.VaultAPI{}
+		if err = vaulter.InitAPI(api, vaultCFG, vaultCFG.ParentToken); err != nil {
 			log.Fatal(err)
 		}
+		vaultAPI = api
+		if dryRun {
+			vaultAPI = newRecorder(api)
+		}
+
+		if isDestructive(cmd) {
+			confirmContext(cmd)
+		}
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		rec, ok := vaultAPI.(*recorder)
+		if !ok {
+			return
+		}
+		rec.printPlan(os.Stdout)
+		if len(rec.changes) > 0 {
+			os.Exit(pendingChangesExitCode)
+		}
 	},
 }
 
@@ -72,8 +149,12 @@ var (
 )
 
 func init() {
+	RootCmd.PersistentFlags().StringVar(&configPath, "config", "", "The path to a YAML, TOML, or HCL file containing flag values.")
+	RootCmd.PersistentFlags().StringVar(&contextName, "context", "", "The name of the context to use instead of the current one.")
 	RootCmd.PersistentFlags().StringVarP(&parentToken, "token", "t", "", "The Vault parent token.")
 	RootCmd.PersistentFlags().StringVarP(&vaultURL, "api-url", "u", "http://127.0.0.1:8200", "The URL for the Vault API.")
+	RootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Print the changes that would be made to Vault instead of making them. Exits with 2 if changes are pending.")
+	RootCmd.PersistentFlags().StringVar(&caCert, "ca-cert", "", "The CA cert used to verify the Vault server's TLS cert.")
 	RootCmd.PersistentFlags().StringVarP(&clientCert, "client-cert", "c", "", "The client TLS certificate to use for the Vault connection.")
 	RootCmd.PersistentFlags().StringVarP(&clientKey, "client-key", "k", "", "The client key to use for TLS connection to the Vault API.")
 }
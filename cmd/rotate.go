@@ -0,0 +1,13 @@
+package cmd
+
+import "github.com/spf13/cobra"
+
+var rotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replaces the Vault resources represented by the subcommands.",
+	Long:  `Replaces the Vault resources represented by the subcommands.`,
+}
+
+func init() {
+	RootCmd.AddCommand(rotateCmd)
+}
@@ -0,0 +1,13 @@
+package cmd
+
+import "github.com/spf13/cobra"
+
+var signCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Signs the requests represented by the subcommands with Vault.",
+	Long:  `Signs the requests represented by the subcommands with Vault.`,
+}
+
+func init() {
+	RootCmd.AddCommand(signCmd)
+}
@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// How often and for how long 'tidy' polls the tidy status of the backend for
+// the number of entries that were actually removed.
+const (
+	tidyPollInterval = time.Second
+	tidyPollTimeout  = 5 * time.Minute
+)
+
+// tidyStatus is the progress of a tidy operation as reported by the backend.
+type tidyStatus struct {
+	state          string
+	errMsg         string
+	certsDeleted   int64
+	revokedDeleted int64
+}
+
+// readTidyStatus reads the status of the last tidy operation on the mount.
+// Returns nil if the backend doesn't report it, as is the case for older Vault
+// releases.
+func readTidyStatus(mount string) (*tidyStatus, error) {
+	statusSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/tidy-status", mount))
+	if err != nil {
+		return nil, err
+	}
+	if statusSecret == nil || statusSecret.Data == nil {
+		return nil, nil
+	}
+	count := func(key string) int64 {
+		if n, ok := statusSecret.Data[key].(json.Number); ok {
+			v, _ := n.Int64()
+			return v
+		}
+		return 0
+	}
+	status := &tidyStatus{
+		certsDeleted:   count("cert_store_deleted_count"),
+		revokedDeleted: count("revoked_cert_deleted_count"),
+	}
+	status.state, _ = statusSecret.Data["state"].(string)
+	status.errMsg, _ = statusSecret.Data["error"].(string)
+	return status, nil
+}
+
+// waitForTidy polls the tidy status of the mount until the tidy operation
+// finishes, fails, or tidyPollTimeout passes. Returns nil if the backend
+// doesn't report the status or the operation is still running at the end.
+func waitForTidy(mount string) (*tidyStatus, error) {
+	deadline := time.Now().Add(tidyPollTimeout)
+	for {
+		status, err := readTidyStatus(mount)
+		if err != nil || status == nil {
+			return nil, err
+		}
+		switch status.state {
+		case "Finished":
+			return status, nil
+		case "Error":
+			return nil, fmt.Errorf("tidy failed: %s", status.errMsg)
+		}
+		if time.Now().After(deadline) {
+			return nil, nil
+		}
+		time.Sleep(tidyPollInterval)
+	}
+}
+
+// Tidy contains the command for purging expired certs from a PKI backend.
+type Tidy struct {
+	mount        string
+	safetyBuffer string
+	workers      int
+	Tidy         *cobra.Command
+}
+
+// NewTidy returns a newly instantiated *Tidy.
+func NewTidy() *Tidy {
+	t := &Tidy{
+		Tidy: &cobra.Command{
+			Use:         "tidy",
+			Short:       "Purges expired certs from a PKI backend.",
+			Annotations: map[string]string{dryRunAnnotation: "true", destructiveAnnotation: "true"},
+			Long: `Purges certs that expired more than --safety-buffer ago from the cert
+store and the revocation list of the PKI backend at --mount. Vault tidies in the
+background, so the tidy status of the backend is polled until it finishes and
+the number of entries it removed is reported. If the backend doesn't report its
+tidy status, the counts are estimated from the cert store instead and labeled
+as such. With --dry-run, the counts of the entries that would be removed are
+reported without anything being removed, and the exit code is 2 if any would
+be.`,
+		},
+	}
+
+	t.Tidy.Run = t.tidyRun
+
+	t.Tidy.PersistentFlags().StringVar(
+		&t.mount,
+		"mount",
+		defaultIntMount,
+		"The path in Vault to the PKI backend.",
+	)
+	t.Tidy.PersistentFlags().StringVar(
+		&t.safetyBuffer,
+		"safety-buffer",
+		"72h",
+		"Only purge certs that expired longer ago than this.",
+	)
+	t.Tidy.PersistentFlags().IntVar(
+		&t.workers,
+		"workers",
+		defaultWorkers,
+		"The maximum number of certs to read from Vault concurrently.",
+	)
+
+	return t
+}
+
+func (t *Tidy) tidyRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, t.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.mount = mount
+	if t.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+	safetyBuffer, err := parseTTL(t.safetyBuffer)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	fmt.Fprint(w, "Reading the cert store:\t")
+	records, err := listCertRecords(t.mount, t.workers)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	// This mirrors the checks made by the tidy endpoint, which removes
+	// entries for certs that expired more than the safety buffer ago.
+	var expired, revoked int
+	cutoff := time.Now().Add(-safetyBuffer)
+	for _, r := range records {
+		if r.cert.NotAfter.Before(cutoff) {
+			expired++
+			if r.revoked() {
+				revoked++
+			}
+		}
+	}
+
+	tidyPath := fmt.Sprintf("%s/tidy", t.mount)
+	tidyRequest := map[string]interface{}{
+		"tidy_cert_store":      true,
+		"tidy_revocation_list": true,
+		"safety_buffer":        t.safetyBuffer,
+	}
+	if dryRun {
+		// The tidy request is only recorded as a pending change if there's
+		// something for it to purge.
+		if expired > 0 {
+			_, err = vaultAPI.Write(vaultAPI.Client(), tidyPath, tidyRequest)
+			if err != nil {
+				FatalFlush(w, err)
+			}
+		}
+		fmt.Fprintf(w, "Cert store entries to remove:\t%d\t\n", expired)
+		fmt.Fprintf(w, "Revocation list entries to remove:\t%d\t\n", revoked)
+		fmt.Fprintf(w, "Cert store entries remaining:\t%d\t\n", len(records)-expired)
+	} else {
+		fmt.Fprint(w, "Tidying the cert store and revocation list:\t")
+		_, err = vaultAPI.Write(vaultAPI.Client(), tidyPath, tidyRequest)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+
+		// The tidy endpoint only starts the operation, so the real counts
+		// have to be read from the tidy status once it finishes.
+		fmt.Fprint(w, "Waiting for the tidy operation to finish:\t")
+		status, err := waitForTidy(t.mount)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if status == nil {
+			fmt.Fprint(w, "UNKNOWN (no status reported)\t\n")
+			fmt.Fprintf(w, "Cert store entries removed (estimated):\t%d\t\n", expired)
+			fmt.Fprintf(w, "Revocation list entries removed (estimated):\t%d\t\n", revoked)
+			fmt.Fprintf(w, "Cert store entries remaining (estimated):\t%d\t\n", len(records)-expired)
+		} else {
+			fmt.Fprint(w, "SUCCESS\t\n")
+			fmt.Fprintf(w, "Cert store entries removed:\t%d\t\n", status.certsDeleted)
+			fmt.Fprintf(w, "Revocation list entries removed:\t%d\t\n", status.revokedDeleted)
+			remaining := int64(len(records)) - status.certsDeleted
+			if remaining < 0 {
+				remaining = 0
+			}
+			fmt.Fprintf(w, "Cert store entries remaining:\t%d\t\n", remaining)
+		}
+	}
+	w.Flush()
+}
+
+func init() {
+	t := NewTidy()
+	RootCmd.AddCommand(t.Tidy)
+}
@@ -1,12 +1,19 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/cyverse-de/vaulter"
 	vault "github.com/hashicorp/vault/api"
@@ -15,15 +22,42 @@ import (
 
 // TLSGen contains the commands for managing TLS certs and keys.
 type TLSGen struct {
-	mount        string
-	role         string
-	commonName   string
-	certPath     string
-	keyPath      string
-	serialNumber string
-	Check        *cobra.Command
-	Generate     *cobra.Command
-	Revoke       *cobra.Command
+	mount          string
+	role           string
+	commonName     string
+	certPath       string
+	keyPath        string
+	serialNumber   string
+	altNames       []string
+	ipSANs         []string
+	excludeCN      bool
+	keys           keySettings
+	ttl            string
+	minRemaining   string
+	revokeOld      bool
+	expiringWithin string
+	revokedOnly    bool
+	workers        int
+	serialsFile    string
+	yes            bool
+	format         string
+	passwordFile   string
+	alias          string
+	keystorePath   string
+	truststorePath string
+	rootMount      string
+	output         string
+	secretName     string
+	namespace      string
+	manifestPath   string
+	localKey       bool
+	usage          string
+	reuseKey       bool
+	Check          *cobra.Command
+	Generate       *cobra.Command
+	Revoke         *cobra.Command
+	Renew          *cobra.Command
+	List           *cobra.Command
 }
 
 // NewTLSGen returns a newly instantiated *TLSGen.
@@ -32,35 +66,93 @@ func NewTLSGen() *TLSGen {
 		Check: &cobra.Command{
 			Use:   "tls",
 			Short: "Checks the status of a TLS cert/key pair by the serial number.",
-			Long:  "Checks the status of a TLS cert/key pair by the serial number.",
+			Long: `Checks the status of a TLS cert/key pair by the serial number,
+reporting the cert's subject, issuer, subject alternative names, key, validity
+period, fingerprint, and revocation status, whether it's valid for less than
+--min-remaining, and whether it verifies against the CA of the PKI backend at
+--mount. Use --cert-path to inspect a local cert file
+instead, or --manifest-path to inspect the cert in a Secret manifest written by
+'generate tls --output k8s-secret'; either is looked up in Vault by its serial
+number.`,
 		},
 		Generate: &cobra.Command{
 			Use:   "tls",
 			Short: "Generate a new TLS cert/key pair.",
-			Long:  "Generates a new TLS cert/key pair.",
+			Long: `Generates a new TLS cert/key pair with the role at --role, which must already
+exist in the PKI backend at --mount and is not modified; roles are managed with
+'init role'. Without --role, the only role on the mount that allows the
+requested names and whose server_flag and client_flag match --usage (both if
+not set) is used. With --role, --usage is only checked against the role if it
+is set. The requested names, usage, and TTL are checked against the role first.
+With --format pem, the cert and the issuing CA are written to --cert-path and
+the key to --key-path. With --format der, the cert is written to --cert-path
+and the key to --key-path as PKCS#8. With --format pkcs12 or --format jks, the
+key and its cert chain are written to --keystore-path under --alias, and the CA
+certs of the mount and of the root CA at --root-mount are written to
+--truststore-path. Both stores are protected with the password in
+--keystore-password-file. With --output k8s-secret, a kubernetes.io/tls Secret
+manifest named --secret-name is written to --manifest-path instead, containing
+the cert, key, and CA certs, and annotated with the serial number, mount, role,
+and expiry of the cert. With --local-key, the key is generated locally and a
+CSR for it is signed by Vault, so the key never travels over the network.
+Otherwise Vault generates the key with the role's key_type and key_bits, and
+--key-type and --key-bits, if set, must match them.`,
 		},
 		Revoke: &cobra.Command{
+			Use:         "tls",
+			Short:       "Revokes a TLS cert/key pair.",
+			Annotations: map[string]string{destructiveAnnotation: "true"},
+			Long: `Revokes TLS cert/key pairs issued by the PKI backend at --mount. The
+certs to revoke are selected by --serial-number, by the serial number of the
+cert in --cert-path, by matching --common-name against every cert on the mount,
+or by the list of serial numbers in --serials-file. The last two ask for
+confirmation unless --yes is set. The CRL is rebuilt afterwards.`,
+		},
+		Renew: &cobra.Command{
+			Use:         "tls",
+			Short:       "Renews an existing TLS cert/key pair.",
+			Annotations: map[string]string{destructiveAnnotation: "revoke-old"},
+			Long: `Renews an existing TLS cert/key pair by issuing a new cert with the
+same common name and subject alternative names as the cert at --cert-path. The
+mount is determined from the cert's CRL distribution points unless --mount is
+set; certs issued by an intermediate CA that 'rotate intermediate-ca' switched
+away from are renewed by the mount it switched to instead. The role is the only
+role on the mount that allows the cert's names and whose server_flag and
+client_flag match the cert's extended key usages unless --role is set. The cert
+and key files are replaced atomically. Nothing is done if the current cert is
+valid for longer than --min-remaining. Use --manifest-path to renew the cert in
+a Secret manifest written by 'generate tls --output k8s-secret' instead, in
+which case the mount and role recorded in the manifest's annotations are used
+unless overridden. With --reuse-key, the existing key is kept and a CSR for it
+is signed, so services that pin the public key keep working.`,
+		},
+		List: &cobra.Command{
 			Use:   "tls",
-			Short: "Revokes a TLS cert/key pair.",
-			Long:  "Revokes a TLS cert/key pair.",
+			Short: "Lists the TLS certs issued by a PKI backend.",
+			Long: `Lists the TLS certs stored in the PKI backend at --mount along with
+their serial numbers, common names, subject alternative names, validity periods,
+and revocation status. The certs are read with at most --workers concurrent
+requests.`,
 		},
 	}
 
 	t.Check.Run = t.checkRun
 	t.Generate.Run = t.generateRun
 	t.Revoke.Run = t.revokeRun
+	t.Renew.Run = t.renewRun
+	t.List.Run = t.listRun
 
 	t.Generate.PersistentFlags().StringVar(
 		&t.mount,
 		"mount",
 		defaultIntMount,
-		"The path in Vault to the intermediate CA backend.",
+		"The path in Vault to the intermediate CA backend. Defaults to the mount that 'rotate intermediate-ca' switched to on this host, if any.",
 	)
 	t.Generate.PersistentFlags().StringVar(
 		&t.role,
 		"role",
 		"",
-		"The role to create for generating TLS certs/keys. Should be different for each site.",
+		"The role to issue the TLS cert with. Roles are managed with 'init role'. Determined from the mount and --usage if not set.",
 	)
 	t.Generate.PersistentFlags().StringVar(
 		&t.commonName,
@@ -80,13 +172,244 @@ func NewTLSGen() *TLSGen {
 		"",
 		"The file path for the TLS key. Should be writable.",
 	)
+	t.Generate.PersistentFlags().StringSliceVar(
+		&t.altNames,
+		"alt-name",
+		[]string{},
+		"A subject alternative name to include in the TLS cert. May be repeated.",
+	)
+	t.Generate.PersistentFlags().StringSliceVar(
+		&t.ipSANs,
+		"ip-san",
+		[]string{},
+		"An IP subject alternative name to include in the TLS cert. May be repeated.",
+	)
+	t.Generate.PersistentFlags().BoolVar(
+		&t.excludeCN,
+		"exclude-cn-from-sans",
+		false,
+		"Excludes the common name from the subject alternative names in the TLS cert.",
+	)
+	t.keys.addFlags(t.Generate.PersistentFlags())
+	t.Generate.PersistentFlags().StringVar(
+		&t.ttl,
+		"ttl",
+		defaultLeafTTL,
+		"The TTL of the TLS cert. Must not exceed the role's max TTL or the intermediate CA's remaining lifetime.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.format,
+		"format",
+		"pem",
+		"The format to write the TLS cert/key in. One of pem, der, pkcs12, or jks.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.keystorePath,
+		"keystore-path",
+		"",
+		"The file path for the keystore when --format is pkcs12 or jks. Should be writable.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.truststorePath,
+		"truststore-path",
+		"",
+		"The file path for the truststore when --format is pkcs12 or jks. Should be writable.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.passwordFile,
+		"keystore-password-file",
+		"",
+		"The file path for the password protecting the keystore and truststore.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.alias,
+		"alias",
+		"",
+		"The alias for the cert/key in the keystore. Defaults to the common name.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.rootMount,
+		"root-mount",
+		defaultRootMount,
+		"The path in Vault to the root CA pki backend. Set to an empty string if the root CA is not in Vault.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.output,
+		"output",
+		"files",
+		"Where to write the TLS cert/key. One of files or k8s-secret.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.secretName,
+		"secret-name",
+		"",
+		"The name of the Secret when --output is k8s-secret.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.namespace,
+		"namespace",
+		"",
+		"The namespace of the Secret when --output is k8s-secret.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.manifestPath,
+		"manifest-path",
+		"",
+		"The file path for the Secret manifest when --output is k8s-secret. Should be writable.",
+	)
+	t.Generate.PersistentFlags().StringVar(
+		&t.usage,
+		"usage",
+		"",
+		"What the TLS cert will be used for. One of server, client, or both. The role's server_flag and client_flag must match. Defaults to both without --role and to any usage with it.",
+	)
+	t.Generate.PersistentFlags().BoolVar(
+		&t.localKey,
+		"local-key",
+		false,
+		"Generate the key locally and have Vault sign a CSR for it, so the key never leaves this host.",
+	)
+
+	t.Renew.PersistentFlags().StringVar(
+		&t.certPath,
+		"cert-path",
+		"",
+		"The file path for the existing TLS cert. Should be writable.",
+	)
+	t.Renew.PersistentFlags().StringVar(
+		&t.keyPath,
+		"key-path",
+		"",
+		"The file path for the existing TLS key. Should be writable.",
+	)
+	t.Renew.PersistentFlags().StringVar(
+		&t.mount,
+		"mount",
+		defaultIntMount,
+		"The path in Vault to the intermediate CA backend. Determined from the cert if not set.",
+	)
+	t.Renew.PersistentFlags().StringVar(
+		&t.role,
+		"role",
+		"",
+		"The role to use for issuing the new cert. Determined from the mount if not set.",
+	)
+	t.Renew.PersistentFlags().StringVar(
+		&t.ttl,
+		"ttl",
+		defaultLeafTTL,
+		"The TTL of the new TLS cert. Defaults to the lifetime of the existing cert.",
+	)
+	t.Renew.PersistentFlags().StringVar(
+		&t.minRemaining,
+		"min-remaining",
+		"240h",
+		"Skip renewal if the existing cert is valid for longer than this.",
+	)
+	t.Check.PersistentFlags().StringVar(
+		&t.minRemaining,
+		"min-remaining",
+		"240h",
+		"Report the cert as due for renewal if it's valid for less than this.",
+	)
+	t.Renew.PersistentFlags().BoolVar(
+		&t.revokeOld,
+		"revoke-old",
+		false,
+		"Revoke the existing cert after it has been replaced.",
+	)
+	t.Renew.PersistentFlags().StringVar(
+		&t.manifestPath,
+		"manifest-path",
+		"",
+		"The file path for an existing Secret manifest to renew instead of the cert and key files. Should be writable.",
+	)
+	t.Renew.PersistentFlags().StringVar(
+		&t.rootMount,
+		"root-mount",
+		defaultRootMount,
+		"The path in Vault to the root CA pki backend, for the CA certs in the Secret manifest. Set to an empty string if the root CA is not in Vault.",
+	)
+	t.Renew.PersistentFlags().BoolVar(
+		&t.reuseKey,
+		"reuse-key",
+		false,
+		"Have Vault sign a CSR for the existing key instead of generating a new one, keeping the public key the same.",
+	)
+
+	t.List.PersistentFlags().StringVar(
+		&t.mount,
+		"mount",
+		defaultIntMount,
+		"The path in Vault to the intermediate CA backend.",
+	)
+	t.List.PersistentFlags().StringVar(
+		&t.commonName,
+		"common-name",
+		"",
+		"Only list certs with a common name matching this glob pattern.",
+	)
+	t.List.PersistentFlags().StringVar(
+		&t.expiringWithin,
+		"expiring-within",
+		"",
+		"Only list certs that expire within this amount of time.",
+	)
+	t.List.PersistentFlags().BoolVar(
+		&t.revokedOnly,
+		"revoked",
+		false,
+		"Only list revoked certs.",
+	)
+	t.List.PersistentFlags().IntVar(
+		&t.workers,
+		"workers",
+		defaultWorkers,
+		"The maximum number of certs to read from Vault concurrently.",
+	)
 
+	t.Revoke.PersistentFlags().StringVar(
+		&t.mount,
+		"mount",
+		defaultIntMount,
+		"The path in Vault to the intermediate CA backend.",
+	)
 	t.Revoke.PersistentFlags().StringVar(
 		&t.serialNumber,
 		"serial-number",
 		"",
 		"The serial number for a TLS cert/key.",
 	)
+	t.Revoke.PersistentFlags().StringVar(
+		&t.certPath,
+		"cert-path",
+		"",
+		"The file path for a TLS cert to revoke.",
+	)
+	t.Revoke.PersistentFlags().StringVar(
+		&t.commonName,
+		"common-name",
+		"",
+		"Revoke every cert on the mount with a common name matching this glob pattern.",
+	)
+	t.Revoke.PersistentFlags().StringVar(
+		&t.serialsFile,
+		"serials-file",
+		"",
+		"The file path for a list of serial numbers to revoke, one per line.",
+	)
+	t.Revoke.PersistentFlags().BoolVar(
+		&t.yes,
+		"yes",
+		false,
+		"Do not ask for confirmation before revoking multiple certs.",
+	)
+	t.Revoke.PersistentFlags().IntVar(
+		&t.workers,
+		"workers",
+		defaultWorkers,
+		"The maximum number of certs to read from Vault concurrently when using --common-name.",
+	)
 
 	t.Check.PersistentFlags().StringVar(
 		&t.mount,
@@ -100,42 +423,138 @@ func NewTLSGen() *TLSGen {
 		"",
 		"The serial number for the TLS cert/key.",
 	)
+	t.Check.PersistentFlags().StringVar(
+		&t.certPath,
+		"cert-path",
+		"",
+		"The file path for a TLS cert to inspect instead of looking it up by --serial-number.",
+	)
+	t.Check.PersistentFlags().StringVar(
+		&t.manifestPath,
+		"manifest-path",
+		"",
+		"The file path for a Secret manifest containing a TLS cert to inspect.",
+	)
 
 	return t
 }
 
 func (t *TLSGen) checkRun(cmd *cobra.Command, args []string) {
-	var (
-		err        error
-		certSecret *vault.Secret
-	)
-	if t.serialNumber == "" {
-		log.Fatal("--serial-number must be set.")
+	if t.serialNumber == "" && t.certPath == "" && t.manifestPath == "" {
+		log.Fatal("--serial-number, --cert-path, or --manifest-path must be set.")
+	}
+	minRemaining, err := parseTTL(t.minRemaining)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
 
+	var local *x509.Certificate
+	mount, _, err := tlsMount(cmd, t.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serial := t.serialNumber
+	role := ""
+	if t.manifestPath != "" {
+		fmt.Fprint(w, "Reading the secret manifest:\t")
+		secret, err := readTLSSecret(t.manifestPath)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if local, err = secret.cert(); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+		serial = formatSerial(local.SerialNumber)
+		role = secret.Metadata.Annotations[annotationRole]
+		if !cmd.Flags().Changed("mount") {
+			if secretMount := secret.Metadata.Annotations[annotationMount]; secretMount != "" {
+				mount = secretMount
+			} else if certMount, err := mountFromCert(local); err == nil {
+				mount = certMount
+			}
+		}
+	} else if t.certPath != "" {
+		fmt.Fprint(w, "Reading the cert file:\t")
+		contents, err := ioutil.ReadFile(t.certPath)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if local, err = parseCertPEM(string(contents)); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+		serial = formatSerial(local.SerialNumber)
+		if !cmd.Flags().Changed("mount") {
+			if certMount, err := mountFromCert(local); err == nil {
+				mount = certMount
+			}
+		}
+	}
+
 	fmt.Fprint(w, "Retrieving information about the cert:\t")
-	readPath := fmt.Sprintf("%s/cert/%s", t.mount, t.serialNumber)
-	if certSecret, err = vaultAPI.Read(vaultAPI.Client(), readPath); err != nil {
+	record, err := readCertRecord(mount, serial)
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
-	if certSecret == nil {
-		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, fmt.Errorf("contents of %s were nil", readPath))
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	cert := record.cert
+	if local != nil {
+		fmt.Fprint(w, "Cert file matches the cert in Vault:\t")
+		if bytes.Equal(local.Raw, record.cert.Raw) {
+			fmt.Fprint(w, "YES\t\n")
+		} else {
+			fmt.Fprint(w, "NO\t\n")
+		}
+		cert = local
 	}
-	if certSecret.Data == nil {
-		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, fmt.Errorf("read of %s returned no data", readPath))
+
+	fmt.Fprintf(w, "Mount:\t%s\t\n", mount)
+	if role != "" {
+		fmt.Fprintf(w, "Role:\t%s\t\n", role)
 	}
-	if _, ok := certSecret.Data["revocation_time"]; !ok {
-		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, errors.New("revocation time is missing"))
+	fmt.Fprintf(w, "Serial number:\t%s\t\n", record.serial)
+	fmt.Fprintf(w, "Subject:\t%s\t\n", formatName(cert.Subject))
+	fmt.Fprintf(w, "Issuer:\t%s\t\n", formatName(cert.Issuer))
+	fmt.Fprintf(w, "Subject alternative names:\t%s\t\n", strings.Join(certSANs(cert), ", "))
+	fmt.Fprintf(w, "Extended key usages:\t%s\t\n", strings.Join(certEKUs(cert), ", "))
+	fmt.Fprintf(w, "Key:\t%s\t\n", certKeySettings(cert))
+	fmt.Fprintf(w, "Not before:\t%s\t\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(w, "Not after:\t%s\t\n", cert.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(w, "Days remaining:\t%d\t\n", daysRemaining(cert))
+	fmt.Fprintf(w, "SHA-256 fingerprint:\t%s\t\n", fingerprint(cert))
+	if record.revoked() {
+		fmt.Fprintf(w, "Revoked:\t%s\t\n", record.revokedAt.Format(time.RFC3339))
+	} else {
+		fmt.Fprint(w, "Revoked:\tNO\t\n")
+	}
+	if time.Until(cert.NotAfter) < minRemaining {
+		fmt.Fprint(w, "Due for renewal:\tYES\t\n")
+	} else {
+		fmt.Fprint(w, "Due for renewal:\tNO\t\n")
 	}
-	fmt.Fprint(w, "SUCCESS\t\n")
 
-	fmt.Fprintf(w, "Revocation time:\t%s\t\n", certSecret.Data["revocation_time"])
+	fmt.Fprint(w, "Chain verifies against the mount's CA:\t")
+	caCert, err := readCACert(vaultAPI, mount)
+	if err != nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+		FatalFlush(w, err)
+	}
+	if caCert == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else if err = verifyAgainst(cert, []*x509.Certificate{caCert}); err != nil {
+		fmt.Fprintf(w, "NO (%s)\t\n", err)
+	} else {
+		fmt.Fprint(w, "YES\t\n")
+	}
 	w.Flush()
 }
 
@@ -144,145 +563,777 @@ func (t *TLSGen) generateRun(cmd *cobra.Command, args []string) {
 	if t.mount == "" {
 		log.Fatal("--mount must be set.")
 	}
-	if t.role == "" {
-		log.Fatal("--role must be set.")
-	}
 	if t.commonName == "" {
 		log.Fatal("--common-name must be set.")
 	}
-	if t.certPath == "" {
-		log.Fatal("--cert-path must be set.")
+	if t.usage == "" && t.role == "" {
+		t.usage = "both"
 	}
-	if t.keyPath == "" {
-		log.Fatal("--key-path must be set.")
+	if _, ok := usageFlags[t.usage]; !ok && t.usage != "" {
+		log.Fatal("--usage must be one of server, client, or both.")
+	}
+	switch t.output {
+	case "files":
+	case "k8s-secret":
+		if t.format != "pem" {
+			log.Fatal("--format must be pem when --output is k8s-secret.")
+		}
+		if t.secretName == "" {
+			log.Fatal("--secret-name must be set.")
+		}
+		if t.manifestPath == "" {
+			log.Fatal("--manifest-path must be set.")
+		}
+	default:
+		log.Fatal("--output must be one of files or k8s-secret.")
+	}
+	var password string
+	switch t.format {
+	case "pem", "der":
+		if t.output == "k8s-secret" {
+			break
+		}
+		if t.certPath == "" {
+			log.Fatal("--cert-path must be set.")
+		}
+		if t.keyPath == "" {
+			log.Fatal("--key-path must be set.")
+		}
+	case "pkcs12", "jks":
+		if t.keystorePath == "" {
+			log.Fatal("--keystore-path must be set.")
+		}
+		if t.truststorePath == "" {
+			log.Fatal("--truststore-path must be set.")
+		}
+		if t.passwordFile == "" {
+			log.Fatal("--keystore-password-file must be set.")
+		}
+		if password, err = readKeystorePassword(t.passwordFile); err != nil {
+			log.Fatal(err)
+		}
+		if t.alias == "" {
+			t.alias = t.commonName
+		}
+	default:
+		log.Fatal("--format must be one of pem, der, pkcs12, or jks.")
+	}
+	var mountSource string
+	if t.mount, mountSource, err = tlsMount(cmd, t.mount); err != nil {
+		log.Fatal(err)
+	}
+	if err = t.keys.validate(); err != nil {
+		log.Fatal(err)
+	}
+	ttl, err := parseTTL(t.ttl)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	fmt.Fprintf(w, "Mount:\t%s (%s)\t\n", t.mount, mountSource)
 
-	fmt.Fprint(w, "Create a role for cert generation: \t")
-	certRoleConfig := &vaulter.RoleConfig{
-		KeyBits:      4096,
-		MaxTTL:       "8760h",
-		AllowAnyName: true,
+	fmt.Fprint(w, "Checking the TTL against the intermediate CA:\t")
+	caCert, err := readCACert(vaultAPI, t.mount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if caCert == nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, fmt.Errorf("no CA cert found in %s", t.mount))
 	}
-	if _, err = vaulter.CreateRole(vaultAPI, t.mount, t.role, certRoleConfig); err != nil {
+	if err = checkTTL("--ttl", ttl, "the intermediate CA's remaining lifetime", time.Until(caCert.NotAfter)); err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
 	fmt.Fprint(w, "SUCCESS\t\n")
 
-	fmt.Fprint(w, "Create a cert with the role:\t")
-	issueCertConfig := &vaulter.IssueCertConfig{
-		CommonName: t.commonName,
-		TTL:        "720h",
-		Format:     "pem",
+	names := append([]string{t.commonName}, t.altNames...)
+	if t.role == "" {
+		fmt.Fprint(w, "Selecting a role for the usage:\t")
+		if t.role, err = findRole(t.mount, names, t.ipSANs, t.usage); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprintf(w, "%s\t\n", t.role)
+	}
+
+	fmt.Fprint(w, "Checking the request against the role:\t")
+	roleSecret, err := vaultAPI.Read(vaultAPI.Client(), fmt.Sprintf("%s/roles/%s", t.mount, t.role))
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if roleSecret == nil || roleSecret.Data == nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, fmt.Errorf("role %s was not found in %s; create it with 'init role'", t.role, t.mount))
+	}
+	if err = checkNamesAllowed(roleSecret.Data, names, t.ipSANs); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if err = checkRoleUsage(roleSecret.Data, t.usage); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if !t.localKey {
+		var keyType string
+		var keyBits int
+		if cmd.Flags().Changed("key-type") {
+			keyType = t.keys.keyType
+		}
+		if cmd.Flags().Changed("key-bits") {
+			keyBits = t.keys.keyBits
+		}
+		if err = checkRoleKey(roleSecret.Data, keyType, keyBits); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
 	}
-	certSecret, err := vaulter.IssueCert(vaultAPI, t.mount, t.role, issueCertConfig)
+	roleMaxTTL, err := dataDuration(roleSecret.Data["max_ttl"])
 	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
+	if roleMaxTTL > 0 {
+		if err = checkTTL("--ttl", ttl, "the role's max TTL", roleMaxTTL); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	var certSecret *vault.Secret
+	if t.localKey {
+		certSecret = t.signLocalKey(w)
+	} else {
+		fmt.Fprint(w, "Create a cert with the role:\t")
+		issueCertConfig := &vaulter.IssueCertConfig{
+			CommonName:        t.commonName,
+			AltNames:          strings.Join(t.altNames, ","),
+			IPSans:            strings.Join(t.ipSANs, ","),
+			TTL:               t.ttl,
+			Format:            "pem",
+			ExcludeCNFromSans: t.excludeCN,
+		}
+		certSecret, err = vaulter.IssueCert(vaultAPI, t.mount, t.role, issueCertConfig)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
 
-	if _, ok := certSecret.Data["certificate"]; !ok {
+		if _, ok := certSecret.Data["certificate"]; !ok {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, errors.New("no certificate found"))
+		}
+
+		if _, ok := certSecret.Data["issuing_ca"]; !ok {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, errors.New("no issuing CA found"))
+		}
+		if _, ok := certSecret.Data["serial_number"]; !ok {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, errors.New("no serial number found"))
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+
+	switch {
+	case t.output == "k8s-secret":
+		t.writeSecret(w, certSecret)
+	case t.format == "pem":
+		t.writePEM(w, certSecret)
+	case t.format == "der":
+		t.writeDER(w, certSecret)
+	default:
+		t.writeKeystores(w, certSecret, password)
+	}
+
+	fmt.Fprint(w, "TLS cert subject alternative names:\t")
+	issued, err := parseCertPEM(certSecret.Data["certificate"].(string))
+	if err != nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else {
+		fmt.Fprintf(w, "%s\t\n", strings.Join(certSANs(issued), ", "))
+	}
+
+	fmt.Fprint(w, "TLS cert extended key usages:\t")
+	if issued == nil {
+		fmt.Fprint(w, "UNKNOWN\t\n")
+	} else if missing := missingEKUs(issued, t.usage); len(missing) > 0 {
+		fmt.Fprintf(w, "%s (WARNING: missing %s)\t\n", strings.Join(certEKUs(issued), ", "), strings.Join(missing, ", "))
+	} else {
+		fmt.Fprintf(w, "%s\t\n", strings.Join(certEKUs(issued), ", "))
+	}
+
+	fmt.Fprint(w, "TLS cert/key serial number (SAVE THIS):\t")
+	fmt.Fprint(w, fmt.Sprintf("%s\t\n", certSecret.Data["serial_number"]))
+
+	w.Flush()
+}
+
+// signLocalKey generates the key and a CSR for the requested names locally and
+// has the CSR signed with the role. The key is added to the returned secret so
+// that it can be written out the same way as a key generated by Vault.
+func (t *TLSGen) signLocalKey(w *tabwriter.Writer) *vault.Secret {
+	fmt.Fprintf(w, "Generating a %s key locally:\t", &t.keys)
+	key, err := t.keys.generateKey()
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	keyPEM, err := encodeKeyPEM(key)
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, errors.New("no certificate found"))
+		FatalFlush(w, err)
+	}
+	altNames := t.altNames
+	if !t.excludeCN {
+		altNames = append([]string{t.commonName}, t.altNames...)
 	}
+	csr, err := newCertRequest(key, t.commonName, altNames, t.ipSANs)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
 
-	if _, ok := certSecret.Data["issuing_ca"]; !ok {
+	fmt.Fprint(w, "Signing a CSR with the role:\t")
+	certSecret, err := signCertRequest(t.mount, t.role, csr, t.ttl)
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, errors.New("no issuing CA found"))
+		FatalFlush(w, err)
 	}
-	if _, ok := certSecret.Data["serial_number"]; !ok {
+	if err = checkIssuedCert(certSecret); err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, errors.New("no serial number found"))
+		FatalFlush(w, err)
 	}
+	certSecret.Data["private_key"] = strings.TrimSpace(string(keyPEM))
 	fmt.Fprint(w, "SUCCESS\t\n")
+	return certSecret
+}
 
-	fmt.Fprint(w, "Writing cert to file:\t")
-	certfile, err := os.Create(t.certPath)
-	defer certfile.Close()
+// writePEM writes the cert followed by the issuing CA to --cert-path and the
+// key to --key-path. The key is only readable by the current user.
+func (t *TLSGen) writePEM(w *tabwriter.Writer, certSecret *vault.Secret) {
+	fmt.Fprint(w, "Writing cert and key to files:\t")
+	keyPEM, ok := certSecret.Data["private_key"].(string)
+	if !ok {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, errors.New("no private key found"))
+	}
+	certPEM := fmt.Sprintf("%s\n%s\n", certSecret.Data["certificate"], certSecret.Data["issuing_ca"])
+	err := writeFilesAtomic(
+		&outputFile{path: t.keyPath, contents: []byte(keyPEM + "\n"), perm: 0600},
+		&outputFile{path: t.certPath, contents: []byte(certPEM), perm: 0644},
+	)
 	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
-	if _, err = io.WriteString(certfile, certSecret.Data["certificate"].(string)); err != nil {
+	fmt.Fprint(w, "SUCCESS\t\n")
+}
+
+// writeDER writes the cert to --cert-path and the key to --key-path as PKCS#8,
+// both DER-encoded.
+func (t *TLSGen) writeDER(w *tabwriter.Writer, certSecret *vault.Secret) {
+	fmt.Fprint(w, "Writing cert and key to files:\t")
+	cert, err := parseCertPEM(certSecret.Data["certificate"].(string))
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
-	if _, err = io.WriteString(certfile, "\n"); err != nil {
+	keyPEM, ok := certSecret.Data["private_key"].(string)
+	if !ok {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, errors.New("no private key found"))
+	}
+	key, err := pkcs8Key(keyPEM)
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
-	if _, err = io.WriteString(certfile, certSecret.Data["issuing_ca"].(string)); err != nil {
+	err = writeFilesAtomic(
+		&outputFile{path: t.keyPath, contents: key, perm: 0600},
+		&outputFile{path: t.certPath, contents: cert.Raw, perm: 0644},
+	)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+}
+
+// writeSecret writes a Secret manifest containing the cert, key, and CA certs
+// to --manifest-path.
+func (t *TLSGen) writeSecret(w *tabwriter.Writer, certSecret *vault.Secret) {
+	fmt.Fprint(w, "Retrieving the CA cert chain:\t")
+	caChain, err := readTrustChain(t.mount, t.rootMount)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	fmt.Fprint(w, "Writing the secret manifest to file:\t")
+	secret := newTLSSecret(t.secretName, t.namespace)
+	if err = secret.setCert(certSecret, t.mount, t.role, caChain); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	if err = writeTLSSecret(t.manifestPath, secret); err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
-	if _, err = io.WriteString(certfile, "\n"); err != nil {
+	fmt.Fprint(w, "SUCCESS\t\n")
+}
+
+// writeKeystores writes the key and its cert chain to --keystore-path and the
+// CA certs returned by readTrustChain to --truststore-path, in the format
+// selected by --format.
+func (t *TLSGen) writeKeystores(w *tabwriter.Writer, certSecret *vault.Secret, password string) {
+	fmt.Fprint(w, "Retrieving the CA cert chain:\t")
+	caChain, err := readCAChain([]string{t.mount}, t.rootMount)
+	var trustChain []*x509.Certificate
+	if err == nil {
+		trustChain, err = readTrustChain(t.mount, t.rootMount)
+	}
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
 	fmt.Fprint(w, "SUCCESS\t\n")
 
-	fmt.Fprint(w, "Write key to file:\t")
-	if _, ok := certSecret.Data["private_key"]; !ok {
+	fmt.Fprintf(w, "Writing %s keystore and truststore to files:\t", t.format)
+	cert, err := parseCertPEM(certSecret.Data["certificate"].(string))
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	keyPEM, ok := certSecret.Data["private_key"].(string)
+	if !ok {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, errors.New("no private key found"))
+	}
+	key, err := pkcs8Key(keyPEM)
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
 
-	keyfile, err := os.Create(t.keyPath)
-	defer keyfile.Close()
+	encode := encodePKCS12
+	if t.format == "jks" {
+		encode = encodeJKS
+	}
+	keystore, err := encode([]keystoreEntry{
+		{alias: t.alias, key: key, chain: append([]*x509.Certificate{cert}, caChain...)},
+	}, password)
 	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
-	if _, err = io.WriteString(keyfile, certSecret.Data["private_key"].(string)); err != nil {
+	truststore, err := encode(truststoreEntries(trustChain), password)
+	if err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
-	if _, err = io.WriteString(keyfile, "\n"); err != nil {
+	err = writeFilesAtomic(
+		&outputFile{path: t.keystorePath, contents: keystore, perm: 0600},
+		&outputFile{path: t.truststorePath, contents: truststore, perm: 0644},
+	)
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
 	fmt.Fprint(w, "SUCCESS\t\n")
+}
 
-	fmt.Fprint(w, "TLS cert/key serial number (SAVE THIS):\t")
-	fmt.Fprint(w, fmt.Sprintf("%s\t\n", certSecret.Data["serial_number"]))
+func (t *TLSGen) revokeRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, t.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.mount = mount
+	var selectors int
+	for _, v := range []string{t.serialNumber, t.certPath, t.commonName, t.serialsFile} {
+		if v != "" {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		log.Fatal("exactly one of --serial-number, --cert-path, --common-name, or --serials-file must be set.")
+	}
+	if t.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+
+	var serials []string
+	switch {
+	case t.serialNumber != "":
+		serials = []string{t.serialNumber}
+	case t.certPath != "":
+		contents, err := ioutil.ReadFile(t.certPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cert, err := parseCertPEM(string(contents))
+		if err != nil {
+			log.Fatal(err)
+		}
+		serials = []string{formatSerial(cert.SerialNumber)}
+	case t.commonName != "":
+		if _, err = path.Match(t.commonName, ""); err != nil {
+			log.Fatal(err)
+		}
+		records, err := listCertRecords(t.mount, t.workers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range records {
+			if r.revoked() || r.cert.IsCA {
+				continue
+			}
+			if matched, _ := path.Match(t.commonName, r.cert.Subject.CommonName); matched {
+				serials = append(serials, r.serial)
+			}
+		}
+	case t.serialsFile != "":
+		if serials, err = readSerialsFile(t.serialsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(serials) == 0 {
+		fmt.Println("No certs to revoke.")
+		return
+	}
+	if (t.commonName != "" || t.serialsFile != "") && !t.yes {
+		for _, s := range serials {
+			fmt.Println(s)
+		}
+		if !confirm(fmt.Sprintf("Revoke the %d certs listed above from %s?", len(serials), t.mount)) {
+			log.Fatal("revocation cancelled")
+		}
+	}
+
+	fmt.Printf("Mount: %s\n", t.mount)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
 
+	failures := 0
+	fmt.Fprint(w, "SERIAL NUMBER\tRESULT\t\n")
+	for _, serial := range serials {
+		if _, err = revokeSerial(t.mount, serial); err != nil {
+			failures++
+			fmt.Fprintf(w, "%s\tFAILURE (%s)\t\n", serial, err)
+		} else {
+			fmt.Fprintf(w, "%s\tSUCCESS\t\n", serial)
+		}
+	}
+
+	fmt.Fprint(w, "Rebuilding the CRL:\t")
+	if err = rotateCRL(t.mount); err != nil {
+		fmt.Fprint(w, "FAILURE\t\n")
+		FatalFlush(w, err)
+	}
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	if failures > 0 {
+		FatalFlush(w, fmt.Errorf("%d of %d revocations failed", failures, len(serials)))
+	}
 	w.Flush()
 }
 
-func (t *TLSGen) revokeRun(cmd *cobra.Command, args []string) {
-	if t.serialNumber == "" {
-		log.Fatal("--serial-number must be set.")
+func (t *TLSGen) renewRun(cmd *cobra.Command, args []string) {
+	if t.manifestPath == "" && t.certPath == "" {
+		log.Fatal("--cert-path or --manifest-path must be set.")
+	}
+	if t.manifestPath == "" && t.keyPath == "" {
+		log.Fatal("--key-path must be set.")
+	}
+	minRemaining, err := parseTTL(t.minRemaining)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
 
-	fmt.Fprint(w, "Revoking TLS cert/key by serial number:\t")
-	revokeSecret, err := vaultAPI.Write(vaultAPI.Client(), fmt.Sprintf("%s/revoke", t.mount), map[string]interface{}{
-		"serial_number": t.serialNumber,
-	})
+	var (
+		current *x509.Certificate
+		secret  *k8sSecret
+	)
+	if t.manifestPath != "" {
+		fmt.Fprint(w, "Reading the existing secret manifest:\t")
+		if secret, err = readTLSSecret(t.manifestPath); err == nil {
+			current, err = secret.cert()
+		}
+	} else {
+		fmt.Fprint(w, "Reading the existing cert:\t")
+		var contents []byte
+		if contents, err = ioutil.ReadFile(t.certPath); err == nil {
+			current, err = parseCertPEM(string(contents))
+		}
+	}
 	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
 		FatalFlush(w, err)
 	}
-	if revokeSecret == nil {
-		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, errors.New("revoke returned nil"))
+	fmt.Fprint(w, "SUCCESS\t\n")
+
+	var (
+		key    crypto.Signer
+		keyPEM string
+	)
+	if t.reuseKey {
+		fmt.Fprint(w, "Reading the existing key:\t")
+		if secret != nil {
+			keyPEM, err = secret.key()
+		} else {
+			var contents []byte
+			contents, err = ioutil.ReadFile(t.keyPath)
+			keyPEM = string(contents)
+		}
+		if err == nil {
+			key, err = parseKeyPEM(keyPEM)
+		}
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		spki, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if !bytes.Equal(spki, current.RawSubjectPublicKeyInfo) {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, errors.New("the existing key does not match the existing cert"))
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+
+	fmt.Fprintf(w, "Existing cert expires:\t%s\t\n", current.NotAfter.Format(time.RFC3339))
+	fmt.Fprint(w, "Renewal required:\t")
+	if time.Until(current.NotAfter) > minRemaining {
+		fmt.Fprint(w, "NO\t\n")
+		w.Flush()
+		return
+	}
+	fmt.Fprint(w, "YES\t\n")
+
+	var ips []string
+	for _, ip := range current.IPAddresses {
+		ips = append(ips, ip.String())
 	}
-	if revokeSecret.Data == nil {
+	names := append([]string{current.Subject.CommonName}, current.DNSNames...)
+	excludeCN := true
+	for _, n := range current.DNSNames {
+		excludeCN = excludeCN && n != current.Subject.CommonName
+	}
+
+	// The cert is reissued by the mount that issued it, unless 'rotate
+	// intermediate-ca' has switched away from that mount since.
+	var certMount string
+	if secret != nil {
+		certMount = secret.Metadata.Annotations[annotationMount]
+	}
+	if certMount == "" {
+		certMount, _ = mountFromCert(current)
+	}
+	mount, err := reissueMount(cmd, t.mount, certMount)
+	if err != nil {
+		FatalFlush(w, err)
+	}
+	fmt.Fprintf(w, "Mount:\t%s\t\n", mount)
+
+	role := t.role
+	if role == "" && secret != nil {
+		role = secret.Metadata.Annotations[annotationRole]
+	}
+	if role == "" {
+		if role, err = findRole(mount, names, ips, certUsage(current)); err != nil {
+			fmt.Fprint(w, "Role:\tUNKNOWN\t\n")
+			FatalFlush(w, err)
+		}
+	}
+	fmt.Fprintf(w, "Role:\t%s\t\n", role)
+
+	ttl := t.ttl
+	if !cmd.Flags().Changed("ttl") {
+		lifetime := current.NotAfter.Sub(current.NotBefore)
+		ttl = (lifetime - lifetime%time.Minute).String()
+	}
+	ttlDuration, err := parseTTL(ttl)
+	if err != nil {
+		FatalFlush(w, err)
+	}
+
+	fmt.Fprint(w, "Checking the TTL against the intermediate CA:\t")
+	caCert, err := readCACert(vaultAPI, mount)
+	if err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, errors.New("revoke returned no data"))
+		FatalFlush(w, err)
 	}
-	if _, ok := revokeSecret.Data["revocation_time"]; !ok {
+	if caCert == nil {
 		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, errors.New("failed to get the revocation time"))
+		FatalFlush(w, fmt.Errorf("no CA cert found in %s", mount))
 	}
-	rtime := revokeSecret.Data["revocation_time"]
-	if rtime == 0 {
+	if err = checkTTL("the TTL", ttlDuration, "the intermediate CA's remaining lifetime", time.Until(caCert.NotAfter)); err != nil {
 		fmt.Fprint(w, "FAILURE\t\n")
-		FatalFlush(w, errors.New("revocation time was 0"))
+		FatalFlush(w, err)
 	}
 	fmt.Fprint(w, "SUCCESS\t\n")
+
+	var certSecret *vault.Secret
+	if key != nil {
+		fmt.Fprint(w, "Signing a CSR for the existing key with the role:\t")
+		csr, err := newCertRequest(key, current.Subject.CommonName, current.DNSNames, ips)
+		if err == nil {
+			certSecret, err = signCertRequest(mount, role, csr, ttl)
+		}
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if err = checkIssuedCert(certSecret); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		certSecret.Data["private_key"] = strings.TrimSpace(keyPEM)
+		fmt.Fprint(w, "SUCCESS\t\n")
+	} else {
+		fmt.Fprint(w, "Create a cert with the role:\t")
+		certSecret, err = vaulter.IssueCert(vaultAPI, mount, role, &vaulter.IssueCertConfig{
+			CommonName:        current.Subject.CommonName,
+			AltNames:          strings.Join(current.DNSNames, ","),
+			IPSans:            strings.Join(ips, ","),
+			TTL:               ttl,
+			Format:            "pem",
+			ExcludeCNFromSans: excludeCN,
+		})
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if err = checkIssuedCert(certSecret); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if _, ok := certSecret.Data["private_key"].(string); !ok {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, errors.New("no private key found"))
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+
+	if secret != nil {
+		fmt.Fprint(w, "Retrieving the CA cert chain:\t")
+		caChain, err := readTrustChain(mount, t.rootMount)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+
+		fmt.Fprint(w, "Replacing the secret manifest:\t")
+		if err = secret.setCert(certSecret, mount, role, caChain); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		if err = writeTLSSecret(t.manifestPath, secret); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	} else {
+		fmt.Fprint(w, "Replacing the cert and key files:\t")
+		err = writeFilesAtomic(
+			&outputFile{path: t.keyPath, contents: []byte(certSecret.Data["private_key"].(string) + "\n"), perm: 0600},
+			&outputFile{path: t.certPath, contents: certChainPEM(certSecret), perm: 0644},
+		)
+		if err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+
+	if t.revokeOld {
+		fmt.Fprint(w, "Revoking the old cert:\t")
+		oldMount, err := mountFromCert(current)
+		if err != nil {
+			oldMount = mount
+		}
+		if _, err = revokeSerial(oldMount, formatSerial(current.SerialNumber)); err != nil {
+			fmt.Fprint(w, "FAILURE\t\n")
+			FatalFlush(w, err)
+		}
+		fmt.Fprint(w, "SUCCESS\t\n")
+	}
+
+	fmt.Fprint(w, "TLS cert/key serial number (SAVE THIS):\t")
+	fmt.Fprintf(w, "%s\t\n", certSecret.Data["serial_number"])
+
+	w.Flush()
+}
+
+func (t *TLSGen) listRun(cmd *cobra.Command, args []string) {
+	mount, _, err := tlsMount(cmd, t.mount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.mount = mount
+	if t.mount == "" {
+		log.Fatal("--mount must be set.")
+	}
+	if t.commonName != "" {
+		if _, err := path.Match(t.commonName, ""); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var expiringWithin time.Duration
+	if t.expiringWithin != "" {
+		if expiringWithin, err = parseTTL(t.expiringWithin); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	records, err := listCertRecords(t.mount, t.workers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Sort(byNotAfter(records))
+
+	fmt.Printf("Mount: %s\n", t.mount)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.StripEscape)
+	fmt.Fprint(w, "SERIAL NUMBER\tCOMMON NAME\tSANS\tNOT BEFORE\tNOT AFTER\tREVOKED\t\n")
+	for _, r := range records {
+		if t.commonName != "" {
+			if matched, _ := path.Match(t.commonName, r.cert.Subject.CommonName); !matched {
+				continue
+			}
+		}
+		if t.expiringWithin != "" && time.Until(r.cert.NotAfter) > expiringWithin {
+			continue
+		}
+		if t.revokedOnly && !r.revoked() {
+			continue
+		}
+		revoked := "NO"
+		if r.revoked() {
+			revoked = r.revokedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			r.serial,
+			r.cert.Subject.CommonName,
+			strings.Join(certSANs(r.cert), ","),
+			r.cert.NotBefore.Format(time.RFC3339),
+			r.cert.NotAfter.Format(time.RFC3339),
+			revoked,
+		)
+	}
 	w.Flush()
 }
 
@@ -291,4 +1342,6 @@ func init() {
 	generateCmd.AddCommand(t.Generate)
 	checkCmd.AddCommand(t.Check)
 	revokeCmd.AddCommand(t.Revoke)
+	renewCmd.AddCommand(t.Renew)
+	listCmd.AddCommand(t.List)
 }
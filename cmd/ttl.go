@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRootMountMaxTTL = "87600h"
+	defaultRootTTL         = "87600h"
+	defaultIntMountMaxTTL  = "26280h"
+	defaultIntTTL          = "8760h"
+	defaultRoleMaxTTL      = "8760h"
+	defaultLeafTTL         = "720h"
+)
+
+// parseTTL parses a TTL in one of the formats accepted by Vault, which is
+// either a Go duration string or an integer number of seconds. Either way, the
+// TTL must be positive.
+func parseTTL(ttl string) (time.Duration, error) {
+	var d time.Duration
+	if secs, err := strconv.ParseInt(ttl, 10, 64); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if d, err = time.ParseDuration(ttl); err != nil {
+		return 0, fmt.Errorf("invalid TTL %q: %s", ttl, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid TTL %q: must be positive", ttl)
+	}
+	return d, nil
+}
+
+// checkTTL returns an error if the TTL described by name exceeds the limit
+// described by limitName. Vault silently truncates TTLs in that situation, so
+// it's better to refuse to run.
+func checkTTL(name string, ttl time.Duration, limitName string, limit time.Duration) error {
+	if ttl > limit {
+		return fmt.Errorf("%s (%s) is longer than %s (%s)", name, ttl, limitName, limit)
+	}
+	return nil
+}
+
+// parseTTLs parses each of the named TTLs, returning the first error
+// encountered.
+func parseTTLs(ttls map[string]string) (map[string]time.Duration, error) {
+	retval := map[string]time.Duration{}
+	for name, ttl := range ttls {
+		d, err := parseTTL(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		retval[name] = d
+	}
+	return retval, nil
+}